@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// exportJob is one background export, data is only set once status is "ready".
+type exportJob struct {
+	status    string
+	data      []byte
+	createdAt time.Time
+}
+
+// exportStore keeps the latest export of every user in memory.
+type exportStore struct {
+	mux  *sync.Mutex
+	jobs map[int]*exportJob
+}
+
+// exports stay downloadable for a day, after that a new one is built
+const exportTTL = 24 * time.Hour
+
+func newExportStore() *exportStore {
+	return &exportStore{
+		mux:  &sync.Mutex{},
+		jobs: map[int]*exportJob{},
+	}
+}
+
+// expired reports whether a finished export is past exportTTL and should be rebuilt.
+func (job *exportJob) expired(now time.Time) bool {
+	return job.status == "ready" && now.Sub(job.createdAt) > exportTTL
+}
+
+// prune drops expired exports so their zips don't stay in memory until the user asks again.
+func (store *exportStore) prune(now time.Time) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	for userId, job := range store.jobs {
+		if job.expired(now) {
+			delete(store.jobs, userId)
+		}
+	}
+}
+
+func accountDelete(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	userId := principal.UserId
+
+	type requestBodyParams struct {
+		Password string `json:"password"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	user, err := GetUserById(db, userId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	err = apiCfg.passwords.Compare(user.Password, bodyFetched.Password)
+	if err != nil {
+		http.Error(w, "password does not match !", http.StatusUnauthorized)
+		return
+	}
+
+	retention, err := apiCfg.retention()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deletedAt, err := db.SoftDeleteUser(userId, apiCfg.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// every login ends, logging in again restores the account
+	err = db.RevokeAllSessions(userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	purgeAt := retention.UserPurgeAt(deletedAt)
+
+	response := struct {
+		PurgeAt time.Time `json:"purge_at"`
+	}{
+		PurgeAt: purgeAt,
+	}
+	respondWithJSON(w, http.StatusAccepted, response)
+}
+
+func accountExport(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	userId := principal.UserId
+
+	store := apiCfg.exports
+	store.mux.Lock()
+	job, found := store.jobs[userId]
+	now := apiCfg.now()
+	// a failed export is retried right away
+	if !found || job.status == "failed" || job.expired(now) {
+		job = &exportJob{status: "pending", createdAt: now}
+		store.jobs[userId] = job
+		go buildExport(db, store, userId, job)
+	}
+	status := job.status
+	data := job.data
+	store.mux.Unlock()
+
+	if status != "ready" {
+		response := struct {
+			Status string `json:"status"`
+		}{
+			Status: status,
+		}
+		respondWithJSON(w, http.StatusAccepted, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, userId))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// buildExport zips the user's profile and chirps as JSON and stores the result on job.
+func buildExport(db *DB, store *exportStore, userId int, job *exportJob) {
+	data, err := exportUserData(db, userId, job.createdAt)
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if err != nil {
+		log.Print("Error building export: " + err.Error())
+		job.status = "failed"
+		return
+	}
+	job.status = "ready"
+	job.data = data
+}
+
+// exportUserData builds the export as of now, the time it was asked for.
+func exportUserData(db *DB, userId int, now time.Time) ([]byte, error) {
+	user, err := GetUserById(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	chirps, err := db.GetChirpsByAuthor(userId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].Id < chirps[j].Id
+	})
+
+	// everything but the password hash
+	profile := struct {
+		Id            int           `json:"id"`
+		Email         string        `json:"email"`
+		Is_Chirpy_Red bool          `json:"is_chirpy_red"`
+		Subscription  *Subscription `json:"subscription,omitempty"`
+		Handle        string        `json:"handle"`
+		DisplayName   string        `json:"display_name"`
+		Bio           string        `json:"bio"`
+		AvatarMediaId string        `json:"avatar_media_id"`
+		CreatedAt     time.Time     `json:"created_at"`
+	}{
+		Id:            user.Id,
+		Email:         user.Email,
+		Is_Chirpy_Red: user.IsChirpyRed(now),
+		Subscription:  user.Subscription,
+		Handle:        user.Handle,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		AvatarMediaId: user.AvatarMediaId,
+		CreatedAt:     user.CreatedAt,
+	}
+
+	files := map[string]interface{}{
+		"profile.json": profile,
+		"chirps.json":  chirps,
+	}
+
+	buf := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buf)
+	for _, name := range []string{"profile.json", "chirps.json"} {
+		content, err := json.MarshalIndent(files[name], "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		f, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestFailedExportIsRetried(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	router := chi.NewRouter()
+	router.With(env.cfg.middlewareScope(scopeProfileRead)).Get("/api/users/me/export", func(w http.ResponseWriter, r *http.Request) {
+		accountExport(w, r, env.db, env.cfg)
+	})
+	failed := &exportJob{status: "failed", createdAt: env.cfg.now()}
+	env.cfg.exports.jobs[user.Id] = failed
+
+	rec := do(t, router, http.MethodGet, "/api/users/me/export", env.accessToken(t, user), nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s, want 202", rec.Code, rec.Body)
+	}
+	env.cfg.exports.mux.Lock()
+	defer env.cfg.exports.mux.Unlock()
+	if env.cfg.exports.jobs[user.Id] == failed {
+		t.Error("the failed export wasn't restarted")
+	}
+}
+
+func TestExportStorePrune(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := newExportStore()
+	store.jobs[1] = &exportJob{status: "ready", data: []byte("zip"), createdAt: now.Add(-exportTTL - time.Minute)}
+	store.jobs[2] = &exportJob{status: "ready", data: []byte("zip"), createdAt: now.Add(-time.Hour)}
+	store.jobs[3] = &exportJob{status: "pending", createdAt: now.Add(-exportTTL - time.Minute)}
+
+	store.prune(now)
+	if _, found := store.jobs[1]; found {
+		t.Error("an expired export was kept")
+	}
+	if _, found := store.jobs[2]; !found {
+		t.Error("a fresh export was dropped")
+	}
+	if _, found := store.jobs[3]; !found {
+		t.Error("an export still being built was dropped")
+	}
+}
@@ -4,18 +4,53 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type apiConfig struct {
+	db             *DB
 	fileserverHits int
-	jwtSecret      []byte
-	polkaKey       string
+	keys           *keyring
+	// polkaKeys are the webhook signing secrets, more than one while Polka rotates them
+	polkaKeys      []string
+	polkaTolerance time.Duration
+	// webhookWake tells the webhook inbox worker there is a new event
+	webhookWake chan struct{}
+	// deliveryWake tells the outgoing webhook worker there is something to send
+	deliveryWake  chan struct{}
+	webhookClient *http.Client
+	// subscriptionGrace is how long a subscription with a failed payment stays active
+	subscriptionGrace time.Duration
+	defaultRetention  Retention
+	exports           *exportStore
+	mailer            Mailer
+	baseURL           string
+	accessTokenTTL    time.Duration
+	maxAccessTokenTTL time.Duration
+	refreshTokenTTL   time.Duration
+	tokenLeeway       time.Duration
+	revocations       *revocationList
+	loginThrottle     *loginThrottle
+	passwords         *passwordHashing
+	passwordPolicy    passwordPolicy
+
+	// plans decide what each user is entitled to, apiRateLimiter enforces their request limits
+	plans          *planCatalog
+	apiRateLimiter *rateLimiter
+
+	// magic link and password reset requests are limited per address and per email
+	magicLinkIPLimiter        *rateLimiter
+	magicLinkEmailLimiter     *rateLimiter
+	passwordResetIPLimiter    *rateLimiter
+	passwordResetEmailLimiter *rateLimiter
+
+	// now is the clock tokens are issued and checked with, tests can swap it for a fake one
+	now func() time.Time
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.HandlerFunc {
@@ -32,80 +67,69 @@ func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func chirpsPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
-	// Validate and parse the JWT token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return apiCfg.jwtSecret, nil
-	})
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	claims, ok := token.Claims.(*jwt.StandardClaims)
-
-	userId := claims.Subject
-
-	numericId, err := strconv.Atoi(userId)
-	if err != nil {
-		return
-	}
+	principal, _ := principalFromContext(r.Context())
+	numericId := principal.UserId
 
-	if !ok || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	if !requireVerified(w, db, numericId) {
 		return
 	}
 
 	type requestBodyParams struct {
-		Body string `json:"body"`
+		Body     string   `json:"body"`
+		MediaIds []string `json:"media_ids"`
+		// PublishAt schedules the chirp instead of posting it now
+		PublishAt *time.Time `json:"publish_at"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	bodyFetched := requestBodyParams{}
-	err = decoder.Decode(&bodyFetched)
+	err := decoder.Decode(&bodyFetched)
 
 	// now the content of the request body is in bodyFetched variable !
 
 	if err != nil {
 		log.Print("Something went wrong!")
 		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
 	}
 
+	user, err := GetUserById(db, numericId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	chirp := bodyFetched.Body
-	// the chirp must be less than 140
-	if len(chirp) > 140 {
+	// the chirp must fit the user's plan, 140 characters without Chirpy Red
+	if len(chirp) > apiCfg.limit(user, limitChirpLength) {
 		http.Error(w, "Chirp is too long !", http.StatusBadRequest)
+		return
 	}
-	// Remove dirty words from the chirp
-	dirtyWords := map[string]bool{
-		"kerfuffle": true,
-		"sharbert":  true,
-		"fornax":    true,
+	if len(bodyFetched.MediaIds) > 0 && !apiCfg.can(user, featureChirpMedia) {
+		http.Error(w, errFeatureNotInPlan.Error(), http.StatusForbidden)
+		return
 	}
-	words := strings.Fields(chirp)
-	var cleanedChirp strings.Builder
-	for _, word := range words {
-		lowerWord := strings.ToLower(word)
-		if dirtyWords[lowerWord] {
-			cleanedChirp.WriteString(strings.Repeat("*", 4))
-		} else {
-			cleanedChirp.WriteString(word)
-		}
-		cleanedChirp.WriteString(" ")
+	if len(bodyFetched.MediaIds) > apiCfg.limit(user, limitMediaPerChirp) {
+		http.Error(w, "Too many media attachments !", http.StatusBadRequest)
+		return
 	}
 
 	// Now our chirp is valid, its time to create the response !
 	// Chirp is a strucutre !
-	cleanedChirpStr := strings.TrimSpace(cleanedChirp.String())
+	cleanedChirpStr := cleanChirp(chirp)
+
+	if bodyFetched.PublishAt != nil {
+		scheduleChirp(w, db, apiCfg, user, cleanedChirpStr, bodyFetched.MediaIds, *bodyFetched.PublishAt)
+		return
+	}
 
 	// Now our chirp is valid, it's time to create the response!
-	responseBody, err := db.CreateChirp(cleanedChirpStr, numericId)
+	responseBody, err := db.CreateChirp(cleanedChirpStr, numericId, bodyFetched.MediaIds, apiCfg.now())
 	if err != nil {
 		log.Print(err)
 		log.Print("Something went wrong in response body!")
 		return
 	}
+	apiCfg.emitEvent(eventChirpCreated, responseBody)
 
 	// Marshal the response into JSON
 	responseJSON, err := json.Marshal(responseBody)
@@ -124,6 +148,28 @@ func chirpsPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfi
 
 }
 
+// cleanChirp replaces dirty words in a chirp body.
+func cleanChirp(chirp string) string {
+	// Remove dirty words from the chirp
+	dirtyWords := map[string]bool{
+		"kerfuffle": true,
+		"sharbert":  true,
+		"fornax":    true,
+	}
+	words := strings.Fields(chirp)
+	var cleanedChirp strings.Builder
+	for _, word := range words {
+		lowerWord := strings.ToLower(word)
+		if dirtyWords[lowerWord] {
+			cleanedChirp.WriteString(strings.Repeat("*", 4))
+		} else {
+			cleanedChirp.WriteString(word)
+		}
+		cleanedChirp.WriteString(" ")
+	}
+	return strings.TrimSpace(cleanedChirp.String())
+}
+
 func chirpsGet(w http.ResponseWriter, r *http.Request, db *DB) {
 	author_id := r.URL.Query().Get("author_id")
 	sorting := r.URL.Query().Get("sort")
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	tokenIssuer     = "chirpy"
+	tokenTypeAccess = "access"
+
+	scopeChirpsWrite  = "chirps:write"
+	scopeProfileRead  = "profile:read"
+	scopeProfileWrite = "profile:write"
+)
+
+// knownScopes are the scopes a personal access token can be created with.
+var knownScopes = map[string]bool{
+	scopeChirpsWrite:  true,
+	scopeProfileRead:  true,
+	scopeProfileWrite: true,
+}
+
+// tokenClaims are the claims of every JWT chirpy issues.
+type tokenClaims struct {
+	jwt.StandardClaims
+	TokenType string `json:"token_type"`
+	// Scope is a space separated list, an empty scope means full access
+	Scope string `json:"scope,omitempty"`
+	// SessionId ties the token to the login it came from, revoking the session revokes the token
+	SessionId string `json:"sid,omitempty"`
+	// ClientId is set on tokens issued to third-party OAuth clients
+	ClientId string `json:"client_id,omitempty"`
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserId    int
+	Scopes    []string
+	SessionId string
+	ClientId  string
+}
+
+// FullAccess reports whether the principal logged in with a password rather than using a scoped token.
+func (p Principal) FullAccess() bool {
+	return len(p.Scopes) == 0
+}
+
+// HasScope reports whether the principal may use scope, principals without scopes may use all of them.
+func (p Principal) HasScope(scope string) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	for _, val := range p.Scopes {
+		if val == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	authorizationString := r.Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
+	if authorizationString == "" || tokenString == authorizationString {
+		return "", errors.New("missing bearer token")
+	}
+	return tokenString, nil
+}
+
+// parseToken checks the signature, algorithm, expiry, issuer and type of a chirpy JWT.
+// Time based claims are checked against the config clock with tokenLeeway of skew allowed.
+func parseToken(apiCfg *apiConfig, tokenString string, tokenType string) (*tokenClaims, error) {
+	parser := jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.ParseWithClaims(tokenString, &tokenClaims{}, apiCfg.keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*tokenClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	err = validateTokenTimes(claims, apiCfg.now(), apiCfg.tokenLeeway)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != tokenIssuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if claims.TokenType != tokenType {
+		return nil, errors.New("token must be of " + tokenType + " type")
+	}
+	if claims.Id == "" || apiCfg.revocations.IsRevoked(claims.Id) {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
+}
+
+// validateTokenTimes is the one place token expiry is checked, exp is required.
+func validateTokenTimes(claims *tokenClaims, now time.Time, leeway time.Duration) error {
+	if claims.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-leeway).Unix() > claims.ExpiresAt {
+		return errors.New("token has expired")
+	}
+	if claims.IssuedAt != 0 && now.Add(leeway).Unix() < claims.IssuedAt {
+		return errors.New("token used before issued")
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Unix() < claims.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+func principalFromRequest(r *http.Request, apiCfg *apiConfig) (Principal, error) {
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		return Principal{}, err
+	}
+	if strings.HasPrefix(tokenString, apiTokenPrefix) {
+		return apiTokenPrincipal(apiCfg, tokenString)
+	}
+	claims, userId, err := parseAccessToken(apiCfg, tokenString)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{
+		UserId:    userId,
+		Scopes:    strings.Fields(claims.Scope),
+		SessionId: claims.SessionId,
+		ClientId:  claims.ClientId,
+	}, nil
+}
+
+// parseAccessToken checks an access token and the session it belongs to. Every access
+// token has a session, one without is rejected rather than trusted.
+func parseAccessToken(apiCfg *apiConfig, tokenString string) (*tokenClaims, int, error) {
+	claims, err := parseToken(apiCfg, tokenString, tokenTypeAccess)
+	if err != nil {
+		return nil, 0, err
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, 0, err
+	}
+	if claims.SessionId == "" {
+		return nil, 0, errors.New("token has no session")
+	}
+	err = checkSession(apiCfg, claims.SessionId, userId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return claims, userId, nil
+}
+
+// sessions are touched at most once a minute so reads don't all turn into writes
+const sessionTouchInterval = time.Minute
+
+func checkSession(apiCfg *apiConfig, sessionId string, userId int) error {
+	session, err := apiCfg.db.GetSession(sessionId)
+	if err != nil || session.Revoked || session.UserId != userId {
+		return errors.New("session has been revoked")
+	}
+	now := apiCfg.now()
+	if now.Sub(session.LastUsedAt) > sessionTouchInterval {
+		err = apiCfg.db.TouchSession(sessionId, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+}
+
+// middlewareAuthRequired rejects requests without a valid access token.
+func (cfg *apiConfig) middlewareAuthRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := principalFromRequest(r, cfg)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		if !cfg.checkRateLimit(w, cfg.db, principal.UserId) {
+			return
+		}
+		ctx := context.WithValue(r.Context(), principalContextKey{}, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// middlewareAuthOptional sets the principal when a token is sent, but an invalid token is still rejected.
+func (cfg *apiConfig) middlewareAuthOptional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg.middlewareAuthRequired(next).ServeHTTP(w, r)
+	})
+}
+
+// middlewareFullAccess requires a token from a password login, scoped tokens are rejected.
+func (cfg *apiConfig) middlewareFullAccess(next http.Handler) http.Handler {
+	return cfg.middlewareAuthRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+		if !principal.FullAccess() {
+			http.Error(w, "this requires a login token, not a scoped token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// middlewareScope requires a valid access token that carries scope.
+func (cfg *apiConfig) middlewareScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return cfg.middlewareAuthRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := principalFromContext(r.Context())
+			if !principal.HasScope(scope) {
+				http.Error(w, "token is missing the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// issueToken signs a chirpy JWT for the user that expires after ttl. claims
+// carries the token type and the optional scope, session and client.
+func issueToken(apiCfg *apiConfig, userId int, ttl time.Duration, claims tokenClaims) (string, error) {
+	tokenId, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := apiCfg.now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        tokenId,
+		Issuer:    tokenIssuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Subject:   strconv.Itoa(userId),
+	}
+	return apiCfg.keys.Sign(claims)
+}
+
+// accessTokenTTLFor returns how long a new access token lives, honoring a client
+// requested lifetime in seconds but never going above the configured maximum.
+func (cfg *apiConfig) accessTokenTTLFor(requestedSeconds int) time.Duration {
+	if requestedSeconds <= 0 {
+		return cfg.accessTokenTTL
+	}
+	// compared in seconds, a huge value would overflow as a Duration
+	if requestedSeconds > int(cfg.maxAccessTokenTTL/time.Second) {
+		return cfg.maxAccessTokenTTL
+	}
+	return time.Duration(requestedSeconds) * time.Second
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestExpiredTokenRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		after  time.Duration
+		status int
+	}{
+		{name: "fresh", after: 0, status: http.StatusOK},
+		{name: "expired within the leeway", after: time.Hour + 20*time.Second, status: http.StatusOK},
+		{name: "expired", after: time.Hour + time.Minute, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := chi.NewRouter()
+			router.With(env.cfg.middlewareAuthRequired).Get("/api/entitlements", func(w http.ResponseWriter, r *http.Request) {
+				entitlementsGet(w, r, env.db, env.cfg)
+			})
+			token := env.accessToken(t, env.createUser(t, "user@example.com"))
+
+			env.clock.Advance(tt.after)
+			rec := do(t, router, http.MethodGet, "/api/entitlements", token, nil)
+			if rec.Code != tt.status {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestAccessTokenWithoutSessionRejected(t *testing.T) {
+	env := newTestEnv(t)
+	router := chi.NewRouter()
+	router.With(env.cfg.middlewareAuthRequired).Get("/api/entitlements", func(w http.ResponseWriter, r *http.Request) {
+		entitlementsGet(w, r, env.db, env.cfg)
+	})
+	user := env.createUser(t, "user@example.com")
+	token, err := issueToken(env.cfg, user.Id, env.cfg.accessTokenTTL, tokenClaims{TokenType: tokenTypeAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(t, router, http.MethodGet, "/api/entitlements", token, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401", rec.Code)
+	}
+}
+
+func TestValidateTokenTimes(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		claims  tokenClaims
+		wantErr bool
+	}{
+		{name: "valid", claims: claimsAt(now.Add(-time.Minute), now.Add(time.Hour)), wantErr: false},
+		{name: "no expiry", claims: claimsAt(now, time.Time{}), wantErr: true},
+		{name: "expired", claims: claimsAt(now.Add(-2*time.Hour), now.Add(-time.Hour)), wantErr: true},
+		{name: "issued in the future", claims: claimsAt(now.Add(time.Hour), now.Add(2*time.Hour)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTokenTimes(&tt.claims, now, 30*time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func claimsAt(issuedAt time.Time, expiresAt time.Time) tokenClaims {
+	claims := tokenClaims{}
+	claims.IssuedAt = issuedAt.Unix()
+	if !expiresAt.IsZero() {
+		claims.ExpiresAt = expiresAt.Unix()
+	}
+	return claims
+}
+
+func TestLoginExpiresInSeconds(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    map[string]interface{}
+		wantTTL time.Duration
+	}{
+		{name: "missing uses the default", body: map[string]interface{}{}, wantTTL: time.Hour},
+		{name: "zero uses the default", body: map[string]interface{}{"expires_in_seconds": 0}, wantTTL: time.Hour},
+		{name: "shorter is honored", body: map[string]interface{}{"expires_in_seconds": 300}, wantTTL: 5 * time.Minute},
+		{name: "longer is capped", body: map[string]interface{}{"expires_in_seconds": 7 * 24 * 3600}, wantTTL: 24 * time.Hour},
+		{name: "too large for a duration is capped", body: map[string]interface{}{"expires_in_seconds": int64(1) << 40}, wantTTL: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := accountRouter(env)
+			env.createUser(t, "user@example.com")
+
+			tt.body["email"] = "user@example.com"
+			tt.body["password"] = testPassword
+			rec := do(t, router, http.MethodPost, "/api/login", "", tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("login: got %d %s", rec.Code, rec.Body)
+			}
+			response := struct {
+				Token string `json:"token"`
+			}{}
+			decodeBody(t, rec, &response)
+			claims, err := parseToken(env.cfg, response.Token, tokenTypeAccess)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ttl := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second
+			if ttl != tt.wantTTL {
+				t.Errorf("token lives %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
@@ -1,23 +1,122 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	// events gets every chirp that is created or deleted, it may be nil
+	events *chirpBus
 }
 
+var (
+	errHandleTaken             = errors.New("handle already taken")
+	errInvalidToken            = errors.New("token is invalid or expired")
+	errEmailTaken              = errors.New("email already in use")
+	errTokenReused             = errors.New("refresh token was already used")
+	errTOTPEnabled             = errors.New("two-factor authentication is already enabled")
+	errChirpNotFound           = errors.New("chirp not found")
+	errInboxEventNotFound      = errors.New("webhook event not found")
+	errWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+	errDeliveryNotFound        = errors.New("webhook delivery not found")
+)
+
 type DBStructure struct {
-	Chirps       map[int]Chirp `json:"chirps"`
-	Users        map[int]User  `json:"users"`
-	RevokeTokens []string      `json:"revoke_tokens"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	RevokedTokens map[string]time.Time    `json:"revoked_tokens"`
+	Follows       []Follow                `json:"follows"`
+	OneTimeTokens map[string]OneTimeToken `json:"one_time_tokens"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	Sessions      map[string]Session      `json:"sessions"`
+	APITokens     map[string]APIToken     `json:"api_tokens"`
+	OAuthClients  map[string]OAuthClient  `json:"oauth_clients"`
+	AuthCodes     map[string]AuthCode     `json:"auth_codes"`
+	// WebhookInbox holds received webhook events by id until they are processed and forgotten
+	WebhookInbox        map[string]InboxEvent      `json:"webhook_inbox"`
+	WebhookEndpoints    map[string]WebhookEndpoint `json:"webhook_endpoints"`
+	WebhookDeliveries   map[string]WebhookDelivery `json:"webhook_deliveries"`
+	SubscriptionHistory []SubscriptionChange       `json:"subscription_history"`
+	ScheduledChirps     map[int]ScheduledChirp     `json:"scheduled_chirps"`
+	// Plans are set by admins, when they are nil the configured plans apply
+	Plans map[string]Plan `json:"plans,omitempty"`
+	// Retention is set by admins, when it is nil the configured defaults apply
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// loadDB reads the whole database file, the caller must hold the lock.
+func (db *DB) loadDB() (DBStructure, error) {
+	dbStructure := DBStructure{}
+	dataRead, err := os.ReadFile(db.path)
+	if err != nil {
+		return dbStructure, err
+	}
+	if len(dataRead) != 0 {
+		err = json.Unmarshal(dataRead, &dbStructure)
+		if err != nil {
+			return dbStructure, err
+		}
+	}
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.OneTimeTokens == nil {
+		dbStructure.OneTimeTokens = map[string]OneTimeToken{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[string]Session{}
+	}
+	if dbStructure.APITokens == nil {
+		dbStructure.APITokens = map[string]APIToken{}
+	}
+	if dbStructure.OAuthClients == nil {
+		dbStructure.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbStructure.AuthCodes == nil {
+		dbStructure.AuthCodes = map[string]AuthCode{}
+	}
+	if dbStructure.RevokedTokens == nil {
+		dbStructure.RevokedTokens = map[string]time.Time{}
+	}
+	if dbStructure.ScheduledChirps == nil {
+		dbStructure.ScheduledChirps = map[int]ScheduledChirp{}
+	}
+	if dbStructure.WebhookEndpoints == nil {
+		dbStructure.WebhookEndpoints = map[string]WebhookEndpoint{}
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = map[string]WebhookDelivery{}
+	}
+	if dbStructure.WebhookInbox == nil {
+		dbStructure.WebhookInbox = map[string]InboxEvent{}
+	}
+	return dbStructure, nil
+}
+
+// writeDB writes the whole database file back, the caller must hold the lock.
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	dataToWrite, err := json.MarshalIndent(dbStructure, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(db.path, dataToWrite, 0644)
 }
 
 func NewDB(path string) (*DB, error) {
@@ -33,7 +132,8 @@ func NewDB(path string) (*DB, error) {
 		path: path,
 		mux:  &sync.RWMutex{},
 	}
-	f, err := os.Create(db.path)
+	// the file is created on first start and kept afterwards, start with --debug to wipe it
+	f, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +142,7 @@ func NewDB(path string) (*DB, error) {
 	return &db, nil
 }
 
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
+func (db *DB) CreateChirp(body string, userId int, mediaIds []string, now time.Time) (Chirp, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
@@ -52,9 +152,11 @@ func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
 	}
 
 	chirp := Chirp{
-		Id:       0,
-		Body:     body,
-		AuthorId: userId,
+		Id:        0,
+		Body:      body,
+		AuthorId:  userId,
+		MediaIds:  mediaIds,
+		CreatedAt: now,
 	}
 
 	dbStructure := DBStructure{}
@@ -76,7 +178,7 @@ func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
 				chirp.Id: chirp,
 			}
 		} else {
-			chirp.Id = len(dbStructure.Chirps) + 1
+			chirp.Id = nextChirpId(dbStructure)
 			dbStructure.Chirps[chirp.Id] = chirp
 		}
 	}
@@ -90,6 +192,7 @@ func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
 	if err != nil {
 		return chirp, err
 	}
+	db.events.Publish(streamChirpCreated, chirp)
 	return chirp, nil
 }
 
@@ -120,62 +223,108 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 	chirps := []Chirp{}
 
 	for _, val := range dbStructure.Chirps {
+		if val.DeletedAt != nil {
+			continue
+		}
+		// chirps of deleted accounts are hidden along with the account
+		if author, found := dbStructure.Users[val.AuthorId]; found && author.DeletedAt != nil {
+			continue
+		}
 		chirps = append(chirps, val)
 	}
 
 	return chirps, nil
 }
 
-func DeleteChirp(id int, db *DB) error {
-	log.Print("entered delete chirp function")
-	dataRead, err := os.ReadFile(db.path)
+// GetChirp returns the chirp with id, deleted or not.
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
-	log.Print("data read")
-	dbStructure := DBStructure{}
-	if len(dataRead) == 0 {
-		log.Print("database = 0")
-		return errors.New("the database is already empty")
-	} else {
-		err := json.Unmarshal(dataRead, &dbStructure)
-		if err != nil {
-			log.Print("error in unmarshalling")
-			return err
+	chirp, found := dbStructure.Chirps[id]
+	if !found {
+		return Chirp{}, errChirpNotFound
+	}
+	return chirp, nil
+}
+
+// GetDeletedChirpsByAuthor returns the user's deleted chirps that haven't been purged yet.
+func (db *DB) GetDeletedChirpsByAuthor(authorId int) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == authorId && chirp.DeletedAt != nil {
+			chirps = append(chirps, chirp)
 		}
+	}
+	return chirps, nil
+}
 
-		if dbStructure.Chirps == nil {
-			log.Print("chirps = 0")
-			return errors.New("there are no chirps to delete")
-		} else {
-			newChirps := make(map[int]Chirp)
-			for key, val := range dbStructure.Chirps {
-				if key == id {
-					// we want to escape this one
-					continue
-				} else {
-					newChirps[key] = val
-				}
-			}
-			log.Print(dbStructure.Chirps)
-			dbStructure.Chirps = newChirps
-			log.Print(dbStructure.Chirps)
-			dataToWrite, err := json.MarshalIndent(dbStructure, "", "  ")
-			if err != nil {
-				return err
-			}
+// SoftDeleteChirp hides the chirp from every read. Deleting a deleted chirp keeps
+// its original deletion time.
+func (db *DB) SoftDeleteChirp(id int, now time.Time) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-			err = os.WriteFile(db.path, dataToWrite, 0644)
-			if err != nil {
-				return err
-			}
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp, found := dbStructure.Chirps[id]
+	if !found {
+		return Chirp{}, errChirpNotFound
+	}
+	if chirp.DeletedAt != nil {
+		return chirp, nil
+	}
+	chirp.DeletedAt = &now
+	dbStructure.Chirps[id] = chirp
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+	db.events.Publish(streamChirpDeleted, chirp)
+	return chirp, nil
+}
 
-		}
+// RestoreChirp undoes SoftDeleteChirp.
+func (db *DB) RestoreChirp(id int) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp, found := dbStructure.Chirps[id]
+	if !found {
+		return Chirp{}, errChirpNotFound
+	}
+	if chirp.DeletedAt == nil {
+		return chirp, nil
+	}
+	chirp.DeletedAt = nil
+	dbStructure.Chirps[id] = chirp
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
 	}
-	return err
+	// streams removed the chirp when it was deleted, to them it is new again
+	db.events.Publish(streamChirpCreated, chirp)
+	return chirp, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
+func (db *DB) CreateUser(email string, password string, handle string, displayName string, now time.Time) (User, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
@@ -188,6 +337,12 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 		log.Print("user already exist....")
 		return User{}, errors.New("user already exists")
 	}
+	if handle != "" {
+		_, err = GetUserByHandle(db, handle)
+		if err == nil {
+			return User{}, errHandleTaken
+		}
+	}
 
 	dataRead, err := os.ReadFile(db.path)
 	if err != nil {
@@ -195,10 +350,12 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	}
 
 	user := User{
-		Id:       0,
-		Email:    email,
-		Password: password,
-		Is_Chirpy_Red: false,
+		Id:          0,
+		Email:       normalizeEmail(email),
+		Password:    password,
+		Handle:      handle,
+		DisplayName: displayName,
+		CreatedAt:   now,
 	}
 
 	dbStructure := DBStructure{}
@@ -218,7 +375,7 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 				user.Id: user,
 			}
 		} else {
-			user.Id = len(dbStructure.Users) + 1
+			user.Id = nextUserId(dbStructure)
 			dbStructure.Users[user.Id] = user
 		}
 	}
@@ -248,7 +405,7 @@ func GetUser(db *DB, email string) (User, error) {
 	users := dbStructure.Users
 
 	for _, val := range users {
-		if val.Email == email {
+		if normalizeEmail(val.Email) == normalizeEmail(email) {
 			return val, nil
 		}
 	}
@@ -276,143 +433,1514 @@ func GetUserById(db *DB, id int) (User, error) {
 	return User{}, errors.New("user not found")
 }
 
-func UpdateUser(id int, newEmail string, newPassword string, db *DB) (User, error) {
-	// Read the data from the database file
+// GetUserByHandle finds a user by handle, handles are compared case-insensitively.
+func GetUserByHandle(db *DB, handle string) (User, error) {
 	dataRead, err := os.ReadFile(db.path)
 	if err != nil {
 		return User{}, err
 	}
+	dbStructure := DBStructure{}
+	json.Unmarshal(dataRead, &dbStructure)
+
+	for _, val := range dbStructure.Users {
+		if val.Handle != "" && strings.EqualFold(val.Handle, handle) {
+			return val, nil
+		}
+	}
+
+	return User{}, errors.New("user not found")
+}
 
-	// Unmarshal the data into a DBStructure variable
-	var dbStructure DBStructure
-	err = json.Unmarshal(dataRead, &dbStructure)
+// UpdateProfile changes the public profile fields of a user, nil fields are left as they are.
+func (db *DB) UpdateProfile(id int, handle *string, displayName *string, bio *string, avatarMediaId *string) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return User{}, err
 	}
 
 	user, found := dbStructure.Users[id]
-
-	if found {
-		user.Email = newEmail
-		user.Password = newPassword
-		dbStructure.Users[id] = user
-	} else {
+	if !found {
 		return User{}, errors.New("user not found")
 	}
+	if handle != nil && *handle != "" {
+		for _, val := range dbStructure.Users {
+			if val.Id != id && strings.EqualFold(val.Handle, *handle) {
+				return User{}, errHandleTaken
+			}
+		}
+	}
 
-	// Marshal the updated dbStructure back into JSON format
-	dataToWrite, err := json.MarshalIndent(dbStructure, "", "  ")
-	if err != nil {
-		return User{}, err
+	if handle != nil {
+		user.Handle = *handle
+	}
+	if displayName != nil {
+		user.DisplayName = *displayName
+	}
+	if bio != nil {
+		user.Bio = *bio
+	}
+	if avatarMediaId != nil {
+		user.AvatarMediaId = *avatarMediaId
 	}
+	dbStructure.Users[id] = user
 
-	// Write the updated data back to the database file
-	err = os.WriteFile(db.path, dataToWrite, 0644)
+	err = db.writeDB(dbStructure)
 	if err != nil {
 		return User{}, err
 	}
-
 	return user, nil
 }
 
-func AddRevoke(db *DB, tokenString string) error {
-	dataRead, err := os.ReadFile(db.path)
+// ProfileCounts returns how many chirps, followers and followed users a user has.
+func (db *DB) ProfileCounts(id int) (chirps int, followers int, following int, err error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == id && chirp.DeletedAt == nil {
+			chirps++
+		}
+	}
+	for _, follow := range dbStructure.Follows {
+		if follow.FolloweeId == id {
+			followers++
+		}
+		if follow.FollowerId == id {
+			following++
+		}
+	}
+	return chirps, followers, following, nil
+}
+
+// Follow records that followerId follows followeeId, it is a no-op if they already do.
+func (db *DB) Follow(followerId int, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return err
 	}
+	for _, follow := range dbStructure.Follows {
+		if follow.FollowerId == followerId && follow.FolloweeId == followeeId {
+			return nil
+		}
+	}
+	dbStructure.Follows = append(dbStructure.Follows, Follow{FollowerId: followerId, FolloweeId: followeeId})
+	return db.writeDB(dbStructure)
+}
 
-	dbStructure := DBStructure{}
-	if len(dataRead) == 0 {
-		dbStructure.RevokeTokens = []string{tokenString}
-	} else {
-		err = json.Unmarshal(dataRead, &dbStructure)
-		if err != nil {
-			log.Print("Error in unmarshalling in AddRevoke function: " + err.Error())
-			return err
+// Unfollow removes the follow of followeeId by followerId, if there is one.
+func (db *DB) Unfollow(followerId int, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	follows := []Follow{}
+	for _, follow := range dbStructure.Follows {
+		if follow.FollowerId == followerId && follow.FolloweeId == followeeId {
+			continue
 		}
-		if dbStructure.RevokeTokens == nil {
-			dbStructure.RevokeTokens = []string{tokenString}
-		} else {
-			dbStructure.RevokeTokens = append(dbStructure.RevokeTokens, tokenString)
+		follows = append(follows, follow)
+	}
+	dbStructure.Follows = follows
+	return db.writeDB(dbStructure)
+}
+
+// SetEmail changes the user's email to an already confirmed address.
+func (db *DB) SetEmail(id int, email string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	for _, val := range dbStructure.Users {
+		if val.Id != id && normalizeEmail(val.Email) == normalizeEmail(email) {
+			return errEmailTaken
 		}
 	}
+	user.Email = normalizeEmail(email)
+	user.EmailVerified = true
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
 
-	updatedData, err := json.MarshalIndent(dbStructure, "", "  ")
+// AddRevocation stores the hash of a revoked token id until the token would have expired anyway.
+func (db *DB) AddRevocation(idHash string, expiresAt time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		log.Print("Error in marshalling in AddRevoke function: " + err.Error())
 		return err
 	}
+	dbStructure.RevokedTokens[idHash] = expiresAt
+	return db.writeDB(dbStructure)
+}
+
+// GetRevocations returns every stored revocation with its expiry.
+func (db *DB) GetRevocations() (map[string]time.Time, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return dbStructure.RevokedTokens, nil
+}
+
+// PruneRevocations drops revocations of tokens that have expired, they can't be used anymore.
+func (db *DB) PruneRevocations(now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	err = os.WriteFile(db.path, updatedData, 0644)
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return err
 	}
+	revoked := map[string]time.Time{}
+	for key, expiresAt := range dbStructure.RevokedTokens {
+		if expiresAt.After(now) {
+			revoked[key] = expiresAt
+		}
+	}
+	if len(revoked) == len(dbStructure.RevokedTokens) {
+		return nil
+	}
+	dbStructure.RevokedTokens = revoked
+	return db.writeDB(dbStructure)
+}
+
+// SoftDeleteUser marks the user as deleted, deleting a deleted user keeps the
+// original deletion time. It returns the deletion time.
+func (db *DB) SoftDeleteUser(id int, now time.Time) (time.Time, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	return nil
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return time.Time{}, errors.New("user not found")
+	}
+	if user.DeletedAt != nil {
+		return *user.DeletedAt, nil
+	}
+	user.DeletedAt = &now
+	dbStructure.Users[id] = user
+	return now, db.writeDB(dbStructure)
 }
 
-func GetRevoke(db *DB, tokenString string) bool {
-	// Read the data from the database file
-	dataRead, err := os.ReadFile(db.path)
+// RestoreUser undoes SoftDeleteUser, it is a no-op if the user isn't deleted.
+func (db *DB) RestoreUser(id int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		// Handle the error, e.g., log or return an error
-		return false
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	if user.DeletedAt == nil {
+		return nil
 	}
+	user.DeletedAt = nil
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
 
-	// Unmarshal the data into a DBStructure object
-	dbStructure := DBStructure{}
-	if err := json.Unmarshal(dataRead, &dbStructure); err != nil {
-		// Handle the error, e.g., log or return an error
-		return false
+// PurgeDeleted permanently removes users and chirps that were deleted longer than the
+// retention period ago. Purged users take their chirps, follows and tokens with them.
+// It returns the ids of the purged users and chirps.
+func (db *DB) PurgeDeleted(now time.Time, retention Retention) ([]int, []int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Check if the token is present in the RevokeTokens slice
-	for _, revokedToken := range dbStructure.RevokeTokens {
-		if revokedToken == tokenString {
-			return true
+	purged := map[int]bool{}
+	users := map[int]User{}
+	for id, user := range dbStructure.Users {
+		if user.DeletedAt != nil && !retention.UserPurgeAt(*user.DeletedAt).After(now) {
+			purged[id] = true
+			continue
 		}
+		users[id] = user
 	}
+	dbStructure.Users = users
+
+	purgedChirps := []int{}
+	chirps := map[int]Chirp{}
+	for id, chirp := range dbStructure.Chirps {
+		if purged[chirp.AuthorId] || (chirp.DeletedAt != nil && !retention.ChirpPurgeAt(*chirp.DeletedAt).After(now)) {
+			purgedChirps = append(purgedChirps, id)
+			continue
+		}
+		chirps[id] = chirp
+	}
+	if len(purged) == 0 && len(purgedChirps) == 0 {
+		return nil, nil, nil
+	}
+	dbStructure.Chirps = chirps
+	follows := []Follow{}
+	for _, follow := range dbStructure.Follows {
+		if purged[follow.FollowerId] || purged[follow.FolloweeId] {
+			continue
+		}
+		follows = append(follows, follow)
+	}
+	dbStructure.Follows = follows
+
+	refreshTokens := map[string]RefreshToken{}
+	for key, val := range dbStructure.RefreshTokens {
+		if !purged[val.UserId] {
+			refreshTokens[key] = val
+		}
+	}
+	dbStructure.RefreshTokens = refreshTokens
+
+	sessions := map[string]Session{}
+	for key, val := range dbStructure.Sessions {
+		if !purged[val.UserId] {
+			sessions[key] = val
+		}
+	}
+	dbStructure.Sessions = sessions
+
+	apiTokens := map[string]APIToken{}
+	for key, val := range dbStructure.APITokens {
+		if !purged[val.UserId] {
+			apiTokens[key] = val
+		}
+	}
+	dbStructure.APITokens = apiTokens
+
+	scheduled := map[int]ScheduledChirp{}
+	for key, val := range dbStructure.ScheduledChirps {
+		if !purged[val.AuthorId] {
+			scheduled[key] = val
+		}
+	}
+	dbStructure.ScheduledChirps = scheduled
+
+	history := []SubscriptionChange{}
+	for _, change := range dbStructure.SubscriptionHistory {
+		if !purged[change.UserId] {
+			history = append(history, change)
+		}
+	}
+	dbStructure.SubscriptionHistory = history
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := []int{}
+	for id := range purged {
+		ids = append(ids, id)
+	}
+	return ids, purgedChirps, nil
+}
 
-	// Token not found in the RevokeTokens slice
-	return false
+// nextChirpId returns the id for a new chirp, chirps get purged so the count can be
+// lower than the highest id.
+func nextChirpId(dbStructure DBStructure) int {
+	next := 0
+	for id := range dbStructure.Chirps {
+		if id > next {
+			next = id
+		}
+	}
+	return next + 1
 }
 
-func ChirpyRed(db * DB, id int) error {
+// nextUserId returns the id for a new user, like chirp ids it can't be the count
+// because users get purged.
+func nextUserId(dbStructure DBStructure) int {
+	next := 0
+	for id := range dbStructure.Users {
+		if id > next {
+			next = id
+		}
+	}
+	return next + 1
+}
 
+// GetChirpsByAuthor returns every chirp written by the given user that isn't deleted, it may be empty.
+func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	// Read the data from the database file
-	dataRead, err := os.ReadFile(db.path)
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		return  err
+		return nil, err
 	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == authorId && chirp.DeletedAt == nil {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
+
+// SaveOneTimeToken stores a single-use token under its hash.
+func (db *DB) SaveOneTimeToken(tokenHash string, token OneTimeToken) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	// Unmarshal the data into a DBStructure variable
-	var dbStructure DBStructure
-	err = json.Unmarshal(dataRead, &dbStructure)
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return err
 	}
+	dbStructure.OneTimeTokens[tokenHash] = token
+	return db.writeDB(dbStructure)
+}
 
-	user, found := dbStructure.Users[id]
+// GetOneTimeToken returns the token without using it up.
+func (db *DB) GetOneTimeToken(tokenHash string) (OneTimeToken, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	if found {
-		user.Is_Chirpy_Red = true
-		dbStructure.Users[id] = user
-	} else {
-		return errors.New("user not found")
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	token, found := dbStructure.OneTimeTokens[tokenHash]
+	if !found {
+		return OneTimeToken{}, errInvalidToken
 	}
+	return token, nil
+}
 
-	// Marshal the updated dbStructure back into JSON format
-	dataToWrite, err := json.MarshalIndent(dbStructure, "", "  ")
+// ConsumeOneTimeToken removes the token and returns it if it exists, has not expired
+// and was issued for purpose. Expired tokens are dropped on the way.
+func (db *DB) ConsumeOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		return err
+		return OneTimeToken{}, err
 	}
 
-	// Write the updated data back to the database file
-	err = os.WriteFile(db.path, dataToWrite, 0644)
+	token, found := dbStructure.OneTimeTokens[tokenHash]
+	tokens := map[string]OneTimeToken{}
+	for key, val := range dbStructure.OneTimeTokens {
+		if key == tokenHash && val.Purpose == purpose {
+			continue
+		}
+		if val.ExpiresAt.Before(now) {
+			continue
+		}
+		tokens[key] = val
+	}
+	dbStructure.OneTimeTokens = tokens
+
+	err = db.writeDB(dbStructure)
 	if err != nil {
-		return err
+		return OneTimeToken{}, err
 	}
+	if !found || token.Purpose != purpose || token.ExpiresAt.Before(now) {
+		return OneTimeToken{}, errInvalidToken
+	}
+	return token, nil
+}
 
-	return nil
-}
\ No newline at end of file
+// SetEmailVerified marks the user's current email as verified.
+func (db *DB) SetEmailVerified(id int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	user.EmailVerified = true
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// SetPassword replaces the user's password hash.
+func (db *DB) SetPassword(id int, hashedPassword string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	user.Password = hashedPassword
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// SaveRefreshToken stores a new refresh token under its hash.
+func (db *DB) SaveRefreshToken(tokenHash string, token RefreshToken) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.RefreshTokens[tokenHash] = token
+	return db.writeDB(dbStructure)
+}
+
+// RotateRefreshToken swaps the token stored under oldHash for a new one in the same family.
+// Presenting a token that was already rotated revokes the whole family and returns errTokenReused.
+func (db *DB) RotateRefreshToken(oldHash string, newHash string, now time.Time, ttl time.Duration) (RefreshToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	old, found := dbStructure.RefreshTokens[oldHash]
+	if !found || old.Revoked || !old.ExpiresAt.After(now) {
+		return RefreshToken{}, errInvalidToken
+	}
+	if old.RotatedAt != nil {
+		revokeFamily(dbStructure, old.FamilyId)
+		err = db.writeDB(dbStructure)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, errTokenReused
+	}
+
+	// rotated tokens are kept until they expire so reuse can still be spotted
+	refreshTokens := map[string]RefreshToken{}
+	for key, val := range dbStructure.RefreshTokens {
+		if val.ExpiresAt.After(now) {
+			refreshTokens[key] = val
+		}
+	}
+	old.RotatedAt = &now
+	refreshTokens[oldHash] = old
+
+	newToken := RefreshToken{
+		UserId:    old.UserId,
+		FamilyId:  old.FamilyId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	refreshTokens[newHash] = newToken
+	dbStructure.RefreshTokens = refreshTokens
+
+	session, found := dbStructure.Sessions[old.FamilyId]
+	if found {
+		session.LastUsedAt = now
+		dbStructure.Sessions[old.FamilyId] = session
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return newToken, nil
+}
+
+// RevokeRefreshFamily revokes the family of the token stored under tokenHash,
+// the token must be a live refresh token.
+func (db *DB) RevokeRefreshFamily(tokenHash string, now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	token, found := dbStructure.RefreshTokens[tokenHash]
+	if !found || token.Revoked || !token.ExpiresAt.After(now) {
+		return errInvalidToken
+	}
+	revokeFamily(dbStructure, token.FamilyId)
+	return db.writeDB(dbStructure)
+}
+
+// revokeFamily revokes a session and every refresh token in its family, the caller must hold the lock.
+func revokeFamily(dbStructure DBStructure, familyId string) {
+	for key, val := range dbStructure.RefreshTokens {
+		if val.FamilyId == familyId {
+			val.Revoked = true
+			dbStructure.RefreshTokens[key] = val
+		}
+	}
+	session, found := dbStructure.Sessions[familyId]
+	if found {
+		session.Revoked = true
+		dbStructure.Sessions[familyId] = session
+	}
+}
+
+// CreateSession stores a new session.
+func (db *DB) CreateSession(session Session) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.Sessions[session.Id] = session
+	return db.writeDB(dbStructure)
+}
+
+// GetSession returns the session with the given id, revoked or not.
+func (db *DB) GetSession(id string) (Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Session{}, err
+	}
+	session, found := dbStructure.Sessions[id]
+	if !found {
+		return Session{}, errors.New("session not found")
+	}
+	return session, nil
+}
+
+// TouchSession records that the session was just used.
+func (db *DB) TouchSession(id string, now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	session, found := dbStructure.Sessions[id]
+	if !found {
+		return errors.New("session not found")
+	}
+	session.LastUsedAt = now
+	dbStructure.Sessions[id] = session
+	return db.writeDB(dbStructure)
+}
+
+// ListSessions returns the active sessions of a user.
+func (db *DB) ListSessions(userId int) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, session := range dbStructure.Sessions {
+		if session.UserId == userId && !session.Revoked {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the user's sessions together with its refresh tokens.
+func (db *DB) RevokeSession(userId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	session, found := dbStructure.Sessions[id]
+	if !found || session.UserId != userId {
+		return errors.New("session not found")
+	}
+	revokeFamily(dbStructure, id)
+	return db.writeDB(dbStructure)
+}
+
+// RevokeAllSessions revokes every session of the user.
+func (db *DB) RevokeAllSessions(userId int) error {
+	return db.RevokeOtherSessions(userId, "")
+}
+
+// RevokeOtherSessions revokes every session of the user except keep.
+func (db *DB) RevokeOtherSessions(userId int, keep string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	for id, session := range dbStructure.Sessions {
+		if session.UserId == userId && id != keep {
+			revokeFamily(dbStructure, id)
+		}
+	}
+	return db.writeDB(dbStructure)
+}
+
+// CreateAPIToken stores a personal access token under the hash of its secret.
+func (db *DB) CreateAPIToken(secretHash string, token APIToken) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.APITokens[secretHash] = token
+	return db.writeDB(dbStructure)
+}
+
+// GetAPIToken returns the live token stored under secretHash.
+func (db *DB) GetAPIToken(secretHash string, now time.Time) (APIToken, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return APIToken{}, err
+	}
+	token, found := dbStructure.APITokens[secretHash]
+	if !found || token.Revoked || (token.ExpiresAt != nil && !token.ExpiresAt.After(now)) {
+		return APIToken{}, errInvalidToken
+	}
+	return token, nil
+}
+
+// TouchAPIToken records that the token stored under secretHash was just used.
+func (db *DB) TouchAPIToken(secretHash string, now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	token, found := dbStructure.APITokens[secretHash]
+	if !found {
+		return errInvalidToken
+	}
+	token.LastUsedAt = &now
+	dbStructure.APITokens[secretHash] = token
+	return db.writeDB(dbStructure)
+}
+
+// ListAPITokens returns the tokens of a user that have not been revoked.
+func (db *DB) ListAPITokens(userId int) ([]APIToken, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	tokens := []APIToken{}
+	for _, token := range dbStructure.APITokens {
+		if token.UserId == userId && !token.Revoked {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// RevokeAPIToken revokes one of the user's tokens by its public id.
+func (db *DB) RevokeAPIToken(userId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	for key, token := range dbStructure.APITokens {
+		if token.Id == id && token.UserId == userId && !token.Revoked {
+			token.Revoked = true
+			dbStructure.APITokens[key] = token
+			return db.writeDB(dbStructure)
+		}
+	}
+	return errors.New("token not found")
+}
+
+// CreateOAuthClient stores a newly registered client.
+func (db *DB) CreateOAuthClient(client OAuthClient) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.OAuthClients[client.Id] = client
+	return db.writeDB(dbStructure)
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client, found := dbStructure.OAuthClients[id]
+	if !found {
+		return OAuthClient{}, errors.New("client not found")
+	}
+	return client, nil
+}
+
+// SaveAuthCode stores an authorization code under its hash.
+func (db *DB) SaveAuthCode(codeHash string, code AuthCode) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.AuthCodes[codeHash] = code
+	return db.writeDB(dbStructure)
+}
+
+// ConsumeAuthCode removes the code and returns it if it has not expired,
+// a code can only be exchanged once. Expired codes are dropped on the way.
+func (db *DB) ConsumeAuthCode(codeHash string, now time.Time) (AuthCode, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return AuthCode{}, err
+	}
+	code, found := dbStructure.AuthCodes[codeHash]
+	codes := map[string]AuthCode{}
+	for key, val := range dbStructure.AuthCodes {
+		if key != codeHash && val.ExpiresAt.After(now) {
+			codes[key] = val
+		}
+	}
+	dbStructure.AuthCodes = codes
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return AuthCode{}, err
+	}
+	if !found || !code.ExpiresAt.After(now) {
+		return AuthCode{}, errInvalidToken
+	}
+	return code, nil
+}
+
+// SetTOTPSecret stores a new pending TOTP secret, it is not used until EnableTOTP.
+func (db *DB) SetTOTPSecret(id int, secret string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return errTOTPEnabled
+	}
+	user.TOTPSecret = secret
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// EnableTOTP turns on two-factor authentication, step is the time step of the
+// code that confirmed the secret so it can't be used again.
+func (db *DB) EnableTOTP(id int, step int64, recoveryCodeHashes []string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return errTOTPEnabled
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = recoveryCodeHashes
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// DisableTOTP turns off two-factor authentication and forgets the secret and recovery codes.
+func (db *DB) DisableTOTP(id int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// UseTOTPStep records that a code of step was accepted. Codes of the same or an
+// earlier step are replays and return errInvalidToken.
+func (db *DB) UseTOTPStep(id int, step int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	if step <= user.TOTPLastStep {
+		return errInvalidToken
+	}
+	user.TOTPLastStep = step
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// UseRecoveryCode removes the recovery code with codeHash, returning errInvalidToken if there is none.
+func (db *DB) UseRecoveryCode(id int, codeHash string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	remaining := []string{}
+	for _, val := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(val), []byte(codeHash)) != 1 {
+			remaining = append(remaining, val)
+		}
+	}
+	if len(remaining) == len(user.RecoveryCodes) {
+		return errInvalidToken
+	}
+	user.RecoveryCodes = remaining
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// SetRequire2FA sets whether the user must use two-factor authentication.
+func (db *DB) SetRequire2FA(id int, required bool) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return errors.New("user not found")
+	}
+	user.Require2FA = required
+	dbStructure.Users[id] = user
+	return db.writeDB(dbStructure)
+}
+
+// GrantRole adds role to the user's roles, granting a role they have is a no-op.
+func (db *DB) GrantRole(id int, role string) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return User{}, errors.New("user not found")
+	}
+	if !user.HasRole(role) {
+		user.Roles = append(user.Roles, role)
+	}
+	dbStructure.Users[id] = user
+	return user, db.writeDB(dbStructure)
+}
+
+// RevokeRole removes role from the user's roles.
+func (db *DB) RevokeRole(id int, role string) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, found := dbStructure.Users[id]
+	if !found {
+		return User{}, errors.New("user not found")
+	}
+	roles := []string{}
+	for _, val := range user.Roles {
+		if val != role {
+			roles = append(roles, val)
+		}
+	}
+	user.Roles = roles
+	dbStructure.Users[id] = user
+	return user, db.writeDB(dbStructure)
+}
+
+// GetRetention returns the retention set by an admin, or nil if none was set.
+func (db *DB) GetRetention() (*Retention, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return dbStructure.Retention, nil
+}
+
+func (db *DB) SetRetention(retention Retention) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.Retention = &retention
+	return db.writeDB(dbStructure)
+}
+
+// EnqueueWebhookEvent stores a received event in the inbox. It returns false for an
+// event id that is already there, so deliveries Polka repeats are only processed once.
+// Processed events older than keepFor are forgotten, by then Polka has stopped retrying.
+func (db *DB) EnqueueWebhookEvent(event InboxEvent, keepFor time.Duration) (bool, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+	for key, val := range dbStructure.WebhookInbox {
+		if val.Status == inboxProcessed && val.ReceivedAt.Before(event.ReceivedAt.Add(-keepFor)) {
+			delete(dbStructure.WebhookInbox, key)
+		}
+	}
+	if _, found := dbStructure.WebhookInbox[event.Id]; found {
+		return false, db.writeDB(dbStructure)
+	}
+	dbStructure.WebhookInbox[event.Id] = event
+	return true, db.writeDB(dbStructure)
+}
+
+// GetWebhookEvents returns the inbox events with the given status, or all of them when it is empty.
+func (db *DB) GetWebhookEvents(status string) ([]InboxEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	events := []InboxEvent{}
+	for _, val := range dbStructure.WebhookInbox {
+		if status == "" || val.Status == status {
+			events = append(events, val)
+		}
+	}
+	return events, nil
+}
+
+func (db *DB) GetWebhookEvent(id string) (InboxEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return InboxEvent{}, err
+	}
+	event, found := dbStructure.WebhookInbox[id]
+	if !found {
+		return InboxEvent{}, errInboxEventNotFound
+	}
+	return event, nil
+}
+
+// UpdateWebhookEvent applies update to a stored inbox event and saves it.
+func (db *DB) UpdateWebhookEvent(id string, update func(event *InboxEvent) error) (InboxEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return InboxEvent{}, err
+	}
+	event, found := dbStructure.WebhookInbox[id]
+	if !found {
+		return InboxEvent{}, errInboxEventNotFound
+	}
+	err = update(&event)
+	if err != nil {
+		return InboxEvent{}, err
+	}
+	dbStructure.WebhookInbox[id] = event
+	return event, db.writeDB(dbStructure)
+}
+
+// ApplySubscriptionEvent updates the user's subscription for a Polka event and records
+// the change. It returns the subscription before and after, after is nil when the
+// event changed nothing or was applied before.
+func (db *DB) ApplySubscriptionEvent(userId int, event string, eventId string, data polkaEventData, now time.Time, grace time.Duration) (*Subscription, *Subscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	user, found := dbStructure.Users[userId]
+	if !found {
+		return nil, nil, errors.New("user not found")
+	}
+	previous := user.Subscription
+	// an event that already changed the subscription is never applied again
+	for _, change := range dbStructure.SubscriptionHistory {
+		if eventId != "" && change.EventId == eventId {
+			return previous, nil, nil
+		}
+	}
+	next, changed := nextSubscription(user.Subscription, event, data, now, grace)
+	if !changed {
+		return previous, nil, nil
+	}
+	fromStatus := ""
+	if user.Subscription != nil {
+		fromStatus = user.Subscription.Status
+	}
+	user.Subscription = &next
+	dbStructure.Users[userId] = user
+	dbStructure.SubscriptionHistory = append(dbStructure.SubscriptionHistory, SubscriptionChange{
+		UserId:           userId,
+		At:               now,
+		Event:            event,
+		EventId:          eventId,
+		FromStatus:       fromStatus,
+		ToStatus:         next.Status,
+		Plan:             next.Plan,
+		CurrentPeriodEnd: next.CurrentPeriodEnd,
+	})
+	return previous, &next, db.writeDB(dbStructure)
+}
+
+// LapseSubscriptions expires every subscription that no longer grants membership
+// and returns the ids of their users.
+func (db *DB) LapseSubscriptions(now time.Time) ([]int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	lapsed := []int{}
+	for id, user := range dbStructure.Users {
+		sub := user.Subscription
+		if sub == nil || sub.Active(now) {
+			continue
+		}
+		if sub.Status != subscriptionActive && sub.Status != subscriptionPastDue && sub.Status != subscriptionCanceled {
+			continue
+		}
+		next := *sub
+		next.Status = subscriptionExpired
+		next.GraceUntil = nil
+		next.UpdatedAt = now
+		user.Subscription = &next
+		dbStructure.Users[id] = user
+		dbStructure.SubscriptionHistory = append(dbStructure.SubscriptionHistory, SubscriptionChange{
+			UserId:           id,
+			At:               now,
+			Event:            subscriptionLapsed,
+			FromStatus:       sub.Status,
+			ToStatus:         next.Status,
+			Plan:             next.Plan,
+			CurrentPeriodEnd: next.CurrentPeriodEnd,
+		})
+		lapsed = append(lapsed, id)
+	}
+	if len(lapsed) == 0 {
+		return nil, nil
+	}
+	return lapsed, db.writeDB(dbStructure)
+}
+
+// GetSubscriptionHistory returns the user's subscription changes, oldest first.
+func (db *DB) GetSubscriptionHistory(userId int) ([]SubscriptionChange, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	history := []SubscriptionChange{}
+	for _, change := range dbStructure.SubscriptionHistory {
+		if change.UserId == userId {
+			history = append(history, change)
+		}
+	}
+	return history, nil
+}
+
+// EditChirp replaces the body of a chirp and marks it as edited.
+func (db *DB) EditChirp(id int, body string, now time.Time) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp, found := dbStructure.Chirps[id]
+	if !found {
+		return Chirp{}, errChirpNotFound
+	}
+	chirp.Body = body
+	chirp.EditedAt = &now
+	dbStructure.Chirps[id] = chirp
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+	db.events.Publish(streamChirpUpdated, chirp)
+	return chirp, nil
+}
+
+func (db *DB) CreateScheduledChirp(scheduled ScheduledChirp) (ScheduledChirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+	scheduled.Id = 1
+	for id := range dbStructure.ScheduledChirps {
+		if id >= scheduled.Id {
+			scheduled.Id = id + 1
+		}
+	}
+	dbStructure.ScheduledChirps[scheduled.Id] = scheduled
+	return scheduled, db.writeDB(dbStructure)
+}
+
+func (db *DB) GetScheduledChirpsByAuthor(authorId int) ([]ScheduledChirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	scheduled := []ScheduledChirp{}
+	for _, val := range dbStructure.ScheduledChirps {
+		if val.AuthorId == authorId {
+			scheduled = append(scheduled, val)
+		}
+	}
+	return scheduled, nil
+}
+
+// DeleteScheduledChirp cancels a scheduled chirp of the given author.
+func (db *DB) DeleteScheduledChirp(id int, authorId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	scheduled, found := dbStructure.ScheduledChirps[id]
+	if !found || scheduled.AuthorId != authorId {
+		return errChirpNotFound
+	}
+	delete(dbStructure.ScheduledChirps, id)
+	return db.writeDB(dbStructure)
+}
+
+// PublishDueChirps turns every scheduled chirp whose time has come into a chirp. Chirps
+// of deleted authors wait, they are published if the account is restored in time.
+func (db *DB) PublishDueChirps(now time.Time) ([]Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	due := []ScheduledChirp{}
+	for _, scheduled := range dbStructure.ScheduledChirps {
+		author, found := dbStructure.Users[scheduled.AuthorId]
+		if !scheduled.PublishAt.After(now) && found && author.DeletedAt == nil {
+			due = append(due, scheduled)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	// publish in order, so the ids follow the publish times
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].PublishAt.Before(due[j].PublishAt)
+	})
+	published := []Chirp{}
+	for _, scheduled := range due {
+		chirp := Chirp{
+			Id:        nextChirpId(dbStructure),
+			Body:      scheduled.Body,
+			AuthorId:  scheduled.AuthorId,
+			MediaIds:  scheduled.MediaIds,
+			CreatedAt: now,
+		}
+		dbStructure.Chirps[chirp.Id] = chirp
+		delete(dbStructure.ScheduledChirps, scheduled.Id)
+		published = append(published, chirp)
+	}
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	for _, chirp := range published {
+		db.events.Publish(streamChirpCreated, chirp)
+	}
+	return published, nil
+}
+
+func (db *DB) GetPlans() (map[string]Plan, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return dbStructure.Plans, nil
+}
+
+func (db *DB) SetPlans(plans map[string]Plan) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	dbStructure.Plans = plans
+	return db.writeDB(dbStructure)
+}
+
+func (db *DB) CreateWebhookEndpoint(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	dbStructure.WebhookEndpoints[endpoint.Id] = endpoint
+	return endpoint, db.writeDB(dbStructure)
+}
+
+func (db *DB) GetWebhookEndpoints() ([]WebhookEndpoint, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []WebhookEndpoint{}
+	for _, val := range dbStructure.WebhookEndpoints {
+		endpoints = append(endpoints, val)
+	}
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint and every delivery to it.
+func (db *DB) DeleteWebhookEndpoint(id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if _, found := dbStructure.WebhookEndpoints[id]; !found {
+		return errWebhookEndpointNotFound
+	}
+	delete(dbStructure.WebhookEndpoints, id)
+	for key, val := range dbStructure.WebhookDeliveries {
+		if val.EndpointId == id {
+			delete(dbStructure.WebhookDeliveries, key)
+		}
+	}
+	return db.writeDB(dbStructure)
+}
+
+// QueueDeliveries creates a pending delivery of the event for every endpoint subscribed
+// to it and returns how many it created. Delivered deliveries older than keepFor are
+// dropped from the log.
+func (db *DB) QueueDeliveries(eventId string, event string, payload []byte, now time.Time, keepFor time.Duration) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+	for key, val := range dbStructure.WebhookDeliveries {
+		if val.Status == deliveryDelivered && val.CreatedAt.Before(now.Add(-keepFor)) {
+			delete(dbStructure.WebhookDeliveries, key)
+		}
+	}
+	queued := 0
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if !endpoint.Subscribed(event) {
+			continue
+		}
+		id, err := randomToken()
+		if err != nil {
+			return 0, err
+		}
+		dbStructure.WebhookDeliveries[id[:24]] = WebhookDelivery{
+			Id:            id[:24],
+			EndpointId:    endpoint.Id,
+			EventId:       eventId,
+			Event:         event,
+			Payload:       payload,
+			CreatedAt:     now,
+			Status:        deliveryPending,
+			NextAttemptAt: now,
+			Log:           []DeliveryAttempt{},
+		}
+		queued++
+	}
+	if queued == 0 {
+		return 0, nil
+	}
+	return queued, db.writeDB(dbStructure)
+}
+
+// GetDeliveries returns the deliveries to an endpoint with a status, an empty filter matches everything.
+func (db *DB) GetDeliveries(endpointId string, status string) ([]WebhookDelivery, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	for _, val := range dbStructure.WebhookDeliveries {
+		if (endpointId == "" || val.EndpointId == endpointId) && (status == "" || val.Status == status) {
+			deliveries = append(deliveries, val)
+		}
+	}
+	return deliveries, nil
+}
+
+// UpdateDelivery applies update to a stored delivery and saves it.
+func (db *DB) UpdateDelivery(id string, update func(delivery *WebhookDelivery) error) (WebhookDelivery, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery, found := dbStructure.WebhookDeliveries[id]
+	if !found {
+		return WebhookDelivery{}, errDeliveryNotFound
+	}
+	err = update(&delivery)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	dbStructure.WebhookDeliveries[id] = delivery
+	return delivery, db.writeDB(dbStructure)
+}
+
+// GetFollowees returns the ids of the users that userId follows.
+func (db *DB) GetFollowees(userId int) ([]int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	followees := []int{}
+	for _, follow := range dbStructure.Follows {
+		if follow.FollowerId == userId {
+			followees = append(followees, follow.FolloweeId)
+		}
+	}
+	return followees, nil
+}
@@ -1,85 +1,107 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
+
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt"
 )
 
-func delete(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
-	chirpID := chi.URLParam(r, "chirpID")
-	numericId, err := strconv.Atoi(chirpID)
+// chirpForOwner loads the chirp in the URL for a delete or restore and writes the error
+// response if the caller may not touch it. Deleted chirps don't exist for anyone
+// but their author and moderators.
+func chirpForOwner(w http.ResponseWriter, r *http.Request, db *DB) (Chirp, bool) {
+	numericId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
 	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+		http.Error(w, "Invalid chirp ID", http.StatusBadRequest)
+		return Chirp{}, false
+	}
+	chirp, err := db.GetChirp(numericId)
+	if errors.Is(err, errChirpNotFound) {
+		http.NotFound(w, r)
+		return Chirp{}, false
 	}
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
-
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return apiCfg.jwtSecret, nil
-	})
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		log.Print("Error loading chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return Chirp{}, false
 	}
 
+	principal, _ := principalFromContext(r.Context())
+	if chirp.AuthorId == principal.UserId {
+		return chirp, true
+	}
+	// moderators may delete and restore anyone's chirps
+	canModerate, err := principalCan(db, principal, permChirpsModerate)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return Chirp{}, false
 	}
+	if canModerate {
+		return chirp, true
+	}
+	if chirp.DeletedAt != nil {
+		http.NotFound(w, r)
+		return Chirp{}, false
+	}
+	http.Error(w, "you can only delete your own chirps", http.StatusForbidden)
+	return Chirp{}, false
+}
 
-	claims, ok := token.Claims.(*jwt.StandardClaims)
-	if !ok || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+// chirpsDelete soft deletes a chirp, it can be restored until the retention period is over.
+// Deleting a chirp that is already deleted succeeds, so clients can safely retry.
+func chirpsDelete(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	chirp, ok := chirpForOwner(w, r, db)
+	if !ok {
 		return
 	}
-
-	claimsAuthorId, err := strconv.Atoi(claims.Subject)
+	deleted, err := db.SoftDeleteChirp(chirp.Id, apiCfg.now())
 	if err != nil {
+		log.Print("Error deleting chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
 		return
 	}
+	// a repeated delete isn't a new event
+	if chirp.DeletedAt == nil {
+		apiCfg.emitEvent(eventChirpDeleted, struct {
+			Id        int       `json:"id"`
+			AuthorId  int       `json:"author_id"`
+			DeletedAt time.Time `json:"deleted_at"`
+		}{
+			Id:        deleted.Id,
+			AuthorId:  deleted.AuthorId,
+			DeletedAt: *deleted.DeletedAt,
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	chirps, err := db.GetChirps()
-	if err != nil {
+func chirpsRestore(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	chirp, ok := chirpForOwner(w, r, db)
+	if !ok {
 		return
 	}
-	if numericId != claimsAuthorId {
-		http.Error(w, "not authorized forbidden", http.StatusForbidden)
+	if chirp.DeletedAt == nil {
+		http.Error(w, "chirp is not deleted", http.StatusConflict)
 		return
 	}
-
-	log.Print("beginning of for loop")
-	foundChirp := false
-	
-	log.Print(chirps)
-	for _,val := range chirps {
-		log.Print(val, numericId)
-		if val.Id == numericId {
-			log.Print("chirp found !")
-			foundChirp = true
-			err := DeleteChirp(numericId, db)
-			if err != nil {
-				log.Print(err.Error())
-				http.Error(w, err.Error(), http.StatusForbidden)
-				return
-			}
-		}
+	retention, err := apiCfg.retention()
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
 	}
-
-	if !foundChirp {
-		http.Error(w, "", http.StatusForbidden)
-		log.Print("Chirp to delete not found")
+	if !retention.ChirpPurgeAt(*chirp.DeletedAt).After(apiCfg.now()) {
+		http.Error(w, "chirp can no longer be restored", http.StatusGone)
+		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	// Set the response status code
-	w.WriteHeader(http.StatusOK)
-
-	// Write an empty JSON object as the response body
-	w.Write([]byte("{}"))
+	chirp, err = db.RestoreChirp(chirp.Id)
+	if err != nil {
+		log.Print("Error restoring chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirp)
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestChirpsDeleteAndRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		actor     string
+		deleted   bool
+		after     time.Duration
+		method    string
+		action    string
+		missing   bool
+		status    int
+		wantTrash bool
+	}{
+		{name: "owner deletes", actor: "owner", method: http.MethodDelete, status: http.StatusNoContent, wantTrash: true},
+		{name: "non-owner deletes", actor: "other", method: http.MethodDelete, status: http.StatusForbidden},
+		{name: "moderator deletes", actor: "moderator", method: http.MethodDelete, status: http.StatusNoContent, wantTrash: true},
+		{name: "missing chirp", actor: "owner", method: http.MethodDelete, missing: true, status: http.StatusNotFound},
+		{name: "restore within the window", actor: "owner", deleted: true, after: 6 * 24 * time.Hour, method: http.MethodPost, action: "/restore", status: http.StatusOK},
+		{name: "restore after the window", actor: "owner", deleted: true, after: 8 * 24 * time.Hour, method: http.MethodPost, action: "/restore", status: http.StatusGone, wantTrash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := chi.NewRouter()
+			router.With(env.cfg.middlewareScope(scopeChirpsWrite)).Delete("/api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
+				chirpsDelete(w, r, env.db, env.cfg)
+			})
+			router.With(env.cfg.middlewareScope(scopeChirpsWrite)).Post("/api/chirps/{chirpID}/restore", func(w http.ResponseWriter, r *http.Request) {
+				chirpsRestore(w, r, env.db, env.cfg)
+			})
+
+			users := map[string]User{
+				"owner":     env.createUser(t, "owner@example.com"),
+				"other":     env.createUser(t, "other@example.com"),
+				"moderator": env.createUser(t, "moderator@example.com"),
+			}
+			_, err := env.db.GrantRole(users["moderator"].Id, roleModerator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err := env.db.CreateChirp("hello", users["owner"].Id, nil, env.cfg.now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.deleted {
+				_, err = env.db.SoftDeleteChirp(chirp.Id, env.cfg.now())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			env.clock.Advance(tt.after)
+
+			chirpId := chirp.Id
+			if tt.missing {
+				chirpId = chirp.Id + 1
+			}
+			path := "/api/chirps/" + strconv.Itoa(chirpId) + tt.action
+			rec := do(t, router, tt.method, path, env.accessToken(t, users[tt.actor]), nil)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+
+			stored, err := env.db.GetChirp(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (stored.DeletedAt != nil) != tt.wantTrash {
+				t.Errorf("got deleted_at %v, want the chirp deleted %v", stored.DeletedAt, tt.wantTrash)
+			}
+		})
+	}
+}
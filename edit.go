@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// chirpsEdit lets the author change a chirp's body if their plan allows editing and the
+// chirp is still inside the plan's edit window. Moderators can delete chirps but never edit them.
+func chirpsEdit(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	numericId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		http.Error(w, "Invalid chirp ID", http.StatusBadRequest)
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+	chirp, err := db.GetChirp(numericId)
+	if errors.Is(err, errChirpNotFound) || (err == nil && chirp.DeletedAt != nil) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Print("Error loading chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	if chirp.AuthorId != principal.UserId {
+		http.Error(w, "you can only edit your own chirps", http.StatusForbidden)
+		return
+	}
+
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !apiCfg.can(user, featureEditChirps) {
+		http.Error(w, errFeatureNotInPlan.Error(), http.StatusForbidden)
+		return
+	}
+	window := time.Duration(apiCfg.limit(user, limitEditWindowSeconds)) * time.Second
+	if apiCfg.now().After(chirp.CreatedAt.Add(window)) {
+		http.Error(w, "the edit window for this chirp has passed", http.StatusForbidden)
+		return
+	}
+
+	type requestBodyParams struct {
+		Body string `json:"body"`
+	}
+	bodyFetched := requestBodyParams{}
+	err = json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	if len(bodyFetched.Body) > apiCfg.limit(user, limitChirpLength) {
+		http.Error(w, "Chirp is too long !", http.StatusBadRequest)
+		return
+	}
+
+	chirp, err = db.EditChirp(chirp.Id, cleanChirp(bodyFetched.Body), apiCfg.now())
+	if err != nil {
+		log.Print("Error editing chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirp)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// planFree is the plan of everyone without an active subscription
+	planFree = "free"
+
+	featureEditChirps      = "edit_chirps"
+	featureChirpMedia      = "chirp_media"
+	featureScheduledChirps = "scheduled_chirps"
+
+	limitChirpLength       = "chirp_length"
+	limitEditWindowSeconds = "edit_window_seconds"
+	limitMediaPerChirp     = "media_per_chirp"
+	// limitRequestsPerMinute is per user across the API, 0 means unlimited
+	limitRequestsPerMinute = "requests_per_minute"
+)
+
+// errFeatureNotInPlan is returned to users whose plan doesn't include what they tried.
+var errFeatureNotInPlan = errors.New("your plan doesn't include this, upgrade to Chirpy Red")
+
+var knownFeatures = map[string]bool{
+	featureEditChirps:      true,
+	featureChirpMedia:      true,
+	featureScheduledChirps: true,
+}
+
+var knownLimits = []string{limitChirpLength, limitEditWindowSeconds, limitMediaPerChirp, limitRequestsPerMinute}
+
+// Plan is what a subscription plan entitles its users to.
+type Plan struct {
+	Features []string       `json:"features"`
+	Limits   map[string]int `json:"limits"`
+}
+
+var defaultPlans = map[string]Plan{
+	planFree: {
+		Features: []string{},
+		Limits: map[string]int{
+			limitChirpLength:       140,
+			limitEditWindowSeconds: 0,
+			limitMediaPerChirp:     0,
+			limitRequestsPerMinute: 120,
+		},
+	},
+	defaultPlan: {
+		Features: []string{featureEditChirps, featureChirpMedia, featureScheduledChirps},
+		Limits: map[string]int{
+			limitChirpLength:       1000,
+			limitEditWindowSeconds: 3600,
+			limitMediaPerChirp:     4,
+			limitRequestsPerMinute: 1200,
+		},
+	},
+}
+
+// validatePlans checks a full set of plan definitions, every plan must set every limit
+// so a missing entry can't silently mean zero.
+func validatePlans(plans map[string]Plan) error {
+	if _, found := plans[planFree]; !found {
+		return fmt.Errorf("the %q plan must be defined", planFree)
+	}
+	if _, found := plans[defaultPlan]; !found {
+		return fmt.Errorf("the %q plan must be defined", defaultPlan)
+	}
+	for name, plan := range plans {
+		for _, feature := range plan.Features {
+			if !knownFeatures[feature] {
+				return fmt.Errorf("plan %q has unknown feature %q", name, feature)
+			}
+		}
+		for limit := range plan.Limits {
+			if !knownLimit(limit) {
+				return fmt.Errorf("plan %q has unknown limit %q", name, limit)
+			}
+		}
+		for _, limit := range knownLimits {
+			val, found := plan.Limits[limit]
+			if !found || val < 0 {
+				return fmt.Errorf("plan %q must set %q to zero or more", name, limit)
+			}
+		}
+		if plan.Limits[limitChirpLength] < 1 {
+			return fmt.Errorf("plan %q must allow chirps of at least one character", name)
+		}
+	}
+	return nil
+}
+
+func knownLimit(limit string) bool {
+	for _, val := range knownLimits {
+		if val == limit {
+			return true
+		}
+	}
+	return false
+}
+
+// requestLimitTTL is how long checkRateLimit trusts a user's request limit before it
+// looks at their plan again, so most requests don't read the database.
+const requestLimitTTL = time.Minute
+
+type cachedLimit struct {
+	limit     int
+	expiresAt time.Time
+}
+
+// planCatalog holds the plan definitions in use, admins can replace them at runtime.
+// It also caches the request limit of recent callers.
+type planCatalog struct {
+	mux    *sync.RWMutex
+	plans  map[string]Plan
+	limits map[int]cachedLimit
+}
+
+// newPlanCatalog uses the plans an admin saved, then the PLANS_FILE, then the built-in defaults.
+func newPlanCatalog(db *DB) (*planCatalog, error) {
+	catalog := &planCatalog{
+		mux:    &sync.RWMutex{},
+		plans:  defaultPlans,
+		limits: map[int]cachedLimit{},
+	}
+	saved, err := db.GetPlans()
+	if err != nil {
+		return nil, err
+	}
+	if saved != nil {
+		err = validatePlans(saved)
+		if err != nil {
+			return nil, fmt.Errorf("saved plans: %w", err)
+		}
+		catalog.plans = saved
+		return catalog, nil
+	}
+	path := os.Getenv("PLANS_FILE")
+	if path == "" {
+		return catalog, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plans := map[string]Plan{}
+	err = json.Unmarshal(data, &plans)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = validatePlans(plans)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	catalog.plans = plans
+	return catalog, nil
+}
+
+func (catalog *planCatalog) All() map[string]Plan {
+	catalog.mux.RLock()
+	defer catalog.mux.RUnlock()
+	return catalog.plans
+}
+
+func (catalog *planCatalog) Get(name string) (Plan, bool) {
+	catalog.mux.RLock()
+	defer catalog.mux.RUnlock()
+	plan, found := catalog.plans[name]
+	return plan, found
+}
+
+func (catalog *planCatalog) Set(plans map[string]Plan) {
+	catalog.mux.Lock()
+	defer catalog.mux.Unlock()
+	catalog.plans = plans
+	catalog.limits = map[int]cachedLimit{}
+}
+
+func (catalog *planCatalog) cachedRequestLimit(userId int, now time.Time) (int, bool) {
+	catalog.mux.RLock()
+	defer catalog.mux.RUnlock()
+	cached, found := catalog.limits[userId]
+	if !found || !now.Before(cached.expiresAt) {
+		return 0, false
+	}
+	return cached.limit, true
+}
+
+func (catalog *planCatalog) cacheRequestLimit(userId int, limit int, now time.Time) {
+	catalog.mux.Lock()
+	defer catalog.mux.Unlock()
+	catalog.limits[userId] = cachedLimit{limit: limit, expiresAt: now.Add(requestLimitTTL)}
+}
+
+// Forget drops the cached request limit of a user whose subscription changed.
+func (catalog *planCatalog) Forget(userId int) {
+	catalog.mux.Lock()
+	defer catalog.mux.Unlock()
+	delete(catalog.limits, userId)
+}
+
+func (catalog *planCatalog) prune(now time.Time) {
+	catalog.mux.Lock()
+	defer catalog.mux.Unlock()
+	for userId, cached := range catalog.limits {
+		if !now.Before(cached.expiresAt) {
+			delete(catalog.limits, userId)
+		}
+	}
+}
+
+// planFor returns the name and definition of the plan the user is on right now.
+// A subscription to a plan that has since been removed gets the default paid plan,
+// so a configuration mistake doesn't take away what people paid for.
+func (cfg *apiConfig) planFor(user User) (string, Plan) {
+	if !user.IsChirpyRed(cfg.now()) {
+		plan, _ := cfg.plans.Get(planFree)
+		return planFree, plan
+	}
+	plan, found := cfg.plans.Get(user.Subscription.Plan)
+	if found {
+		return user.Subscription.Plan, plan
+	}
+	plan, _ = cfg.plans.Get(defaultPlan)
+	return defaultPlan, plan
+}
+
+// can reports whether the user's plan includes feature, handlers check this
+// rather than looking at the subscription.
+func (cfg *apiConfig) can(user User, feature string) bool {
+	_, plan := cfg.planFor(user)
+	for _, val := range plan.Features {
+		if val == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// limit returns the value of a numeric limit of the user's plan.
+func (cfg *apiConfig) limit(user User, name string) int {
+	_, plan := cfg.planFor(user)
+	return plan.Limits[name]
+}
+
+// checkRateLimit enforces the requests per minute of the caller's plan. It writes a 429
+// and returns false when the caller is over the limit.
+func (cfg *apiConfig) checkRateLimit(w http.ResponseWriter, db *DB, userId int) bool {
+	now := cfg.now()
+	limit, found := cfg.plans.cachedRequestLimit(userId, now)
+	if !found {
+		user, err := GetUserById(db, userId)
+		if err != nil {
+			// the auth middleware has already decided what to do about unknown users
+			return true
+		}
+		limit = cfg.limit(user, limitRequestsPerMinute)
+		cfg.plans.cacheRequestLimit(userId, limit, now)
+	}
+	if limit == 0 {
+		return true
+	}
+	allowed, retryAfter := cfg.apiRateLimiter.AllowLimit(strconv.Itoa(userId), limit, now)
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// entitlementsGet tells clients what the caller's plan allows, so they can hide what it doesn't.
+func entitlementsGet(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	name, plan := apiCfg.planFor(user)
+	features := append([]string{}, plan.Features...)
+	sort.Strings(features)
+	respondWithJSON(w, http.StatusOK, struct {
+		Plan     string         `json:"plan"`
+		Features []string       `json:"features"`
+		Limits   map[string]int `json:"limits"`
+	}{
+		Plan:     name,
+		Features: features,
+		Limits:   plan.Limits,
+	})
+}
+
+func adminPlansGet(w http.ResponseWriter, r *http.Request, apiCfg *apiConfig) {
+	respondWithJSON(w, http.StatusOK, apiCfg.plans.All())
+}
+
+// adminPlansPut replaces every plan definition, it takes effect immediately.
+func adminPlansPut(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	plans := map[string]Plan{}
+	err := json.NewDecoder(r.Body).Decode(&plans)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	err = validatePlans(plans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.SetPlans(plans)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	apiCfg.plans.Set(plans)
+	respondWithJSON(w, http.StatusOK, plans)
+}
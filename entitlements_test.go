@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSavedPlansValidated(t *testing.T) {
+	env := newTestEnv(t)
+	err := env.db.SetPlans(map[string]Plan{
+		planFree: {Features: []string{"teleport"}, Limits: defaultPlans[planFree].Limits},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newPlanCatalog(env.db)
+	if err == nil {
+		t.Error("invalid saved plans were loaded")
+	}
+}
+
+func TestRateLimitFollowsPlanChanges(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	setRequestLimit := func(limit int) {
+		plans := map[string]Plan{}
+		for name, plan := range defaultPlans {
+			limits := map[string]int{}
+			for key, val := range plan.Limits {
+				limits[key] = val
+			}
+			limits[limitRequestsPerMinute] = limit
+			plans[name] = Plan{Features: plan.Features, Limits: limits}
+		}
+		env.cfg.plans.Set(plans)
+	}
+	allowed := func() bool {
+		return env.cfg.checkRateLimit(httptest.NewRecorder(), env.db, user.Id)
+	}
+
+	setRequestLimit(2)
+	if !allowed() || !allowed() {
+		t.Fatal("requests within the limit were refused")
+	}
+	if allowed() {
+		t.Fatal("a request over the limit was allowed")
+	}
+
+	// the cached limit goes away with the plans it came from
+	setRequestLimit(4)
+	if !allowed() || !allowed() {
+		t.Error("the raised limit wasn't applied")
+	}
+
+	rec := httptest.NewRecorder()
+	env.cfg.checkRateLimit(rec, env.db, user.Id)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want 429", rec.Code)
+	}
+}
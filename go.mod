@@ -3,8 +3,11 @@ module github.com/krishnanshagarwal112/chirpy
 go 1.20
 
 require (
-	github.com/go-chi/chi/v5 v5.0.8 // indirect
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
+	github.com/go-chi/chi/v5 v5.0.8
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/joho/godotenv v1.5.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.9.0
 )
+
+require golang.org/x/sys v0.8.0 // indirect
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	inboxPending   = "pending"
+	inboxProcessed = "processed"
+	// inboxDead events failed every attempt and wait for an admin to replay them
+	inboxDead = "dead"
+
+	// an event is dead after inboxMaxAttempts
+	inboxMaxAttempts = 8
+
+	// failed webhooks, received or sent, are retried after 30s, 1m, 2m ... up to an hour apart
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+)
+
+// InboxEvent is a received webhook event, it is stored before it is acknowledged
+// so a failure while processing it can't lose it.
+type InboxEvent struct {
+	Id            string          `json:"id"`
+	Source        string          `json:"source"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	ProcessedAt   *time.Time      `json:"processed_at,omitempty"`
+}
+
+// webhookRetryDelay is how long to wait after the given number of failed attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	if attempts > 16 {
+		return webhookRetryMax
+	}
+	delay := webhookRetryBase << (attempts - 1)
+	if delay > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return delay
+}
+
+// applyPolkaEvent does what a Polka event asks for, events we don't handle succeed.
+func applyPolkaEvent(db *DB, apiCfg *apiConfig, event InboxEvent) error {
+	type requestBody struct {
+		Event string         `json:"event"`
+		Data  polkaEventData `json:"data"`
+	}
+	bodyFetched := requestBody{}
+	err := json.NewDecoder(bytes.NewReader(event.Payload)).Decode(&bodyFetched)
+	if err != nil {
+		return err
+	}
+	if !isSubscriptionEvent(bodyFetched.Event) {
+		return nil
+	}
+	now := apiCfg.now()
+	previous, next, err := db.ApplySubscriptionEvent(bodyFetched.Data.UserId, bodyFetched.Event, event.Id, bodyFetched.Data, now, apiCfg.subscriptionGrace)
+	if err != nil {
+		return err
+	}
+	apiCfg.plans.Forget(bodyFetched.Data.UserId)
+	if !previous.Active(now) && next.Active(now) {
+		apiCfg.emitEvent(eventUserUpgraded, struct {
+			UserId           int       `json:"user_id"`
+			Plan             string    `json:"plan"`
+			CurrentPeriodEnd time.Time `json:"current_period_end"`
+		}{
+			UserId:           bodyFetched.Data.UserId,
+			Plan:             next.Plan,
+			CurrentPeriodEnd: next.CurrentPeriodEnd,
+		})
+	}
+	return nil
+}
+
+// processInboxEvent makes one attempt at an event and records how it went.
+func processInboxEvent(db *DB, apiCfg *apiConfig, event InboxEvent) {
+	processErr := applyPolkaEvent(db, apiCfg, event)
+	now := apiCfg.now()
+	_, err := db.UpdateWebhookEvent(event.Id, func(stored *InboxEvent) error {
+		stored.Attempts++
+		if processErr == nil {
+			stored.Status = inboxProcessed
+			stored.ProcessedAt = &now
+			stored.LastError = ""
+			return nil
+		}
+		stored.LastError = processErr.Error()
+		if stored.Attempts >= inboxMaxAttempts {
+			stored.Status = inboxDead
+			return nil
+		}
+		stored.NextAttemptAt = now.Add(webhookRetryDelay(stored.Attempts))
+		return nil
+	})
+	if err != nil {
+		log.Print("Error saving webhook event: " + err.Error())
+		return
+	}
+	if processErr != nil {
+		log.Printf("Webhook event %s failed: %s", event.Id, processErr)
+	}
+}
+
+// processWebhookInbox is the worker that processes inbox events in the order they
+// arrived. It wakes up every interval, or sooner when the webhook handler signals wake.
+func processWebhookInbox(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-apiCfg.webhookWake:
+		}
+		events, err := db.GetWebhookEvents(inboxPending)
+		if err != nil {
+			log.Print("Error loading webhook inbox: " + err.Error())
+			continue
+		}
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+		})
+		now := apiCfg.now()
+		for _, event := range events {
+			if !event.NextAttemptAt.After(now) {
+				processInboxEvent(db, apiCfg, event)
+			}
+		}
+	}
+}
+
+// wakeWebhookWorker asks the worker to look at the inbox now, it never blocks.
+func (cfg *apiConfig) wakeWebhookWorker() {
+	select {
+	case cfg.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// adminWebhooksGet lists inbox events, newest first, optionally only those with ?status=.
+func adminWebhooksGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != inboxPending && status != inboxProcessed && status != inboxDead {
+		http.Error(w, "status must be pending, processed or dead", http.StatusBadRequest)
+		return
+	}
+	events, err := db.GetWebhookEvents(status)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ReceivedAt.After(events[j].ReceivedAt)
+	})
+	respondWithJSON(w, http.StatusOK, events)
+}
+
+func adminWebhookGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	event, err := db.GetWebhookEvent(chi.URLParam(r, "eventID"))
+	if errors.Is(err, errInboxEventNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, event)
+}
+
+// adminWebhookReplay queues an event to be processed again from scratch, it is how
+// dead events are retried once whatever broke them is fixed. Events that were processed
+// can't be replayed, applying them twice would change subscriptions twice.
+func adminWebhookReplay(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	errNotDead := errors.New("only dead events can be replayed")
+	event, err := db.UpdateWebhookEvent(chi.URLParam(r, "eventID"), func(stored *InboxEvent) error {
+		if stored.Status != inboxDead {
+			return errNotDead
+		}
+		stored.Status = inboxPending
+		stored.Attempts = 0
+		stored.NextAttemptAt = apiCfg.now()
+		stored.ProcessedAt = nil
+		return nil
+	})
+	if errors.Is(err, errInboxEventNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errNotDead) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	apiCfg.wakeWebhookWorker()
+	respondWithJSON(w, http.StatusAccepted, event)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// enqueueRenewal puts a subscription renewal for the user in the inbox with the given status.
+func enqueueRenewal(t *testing.T, env *testEnv, id string, user User, status string) InboxEvent {
+	t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event": polkaEventRenewed,
+		"data":  map[string]int{"user_id": user.Id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := InboxEvent{
+		Id:            id,
+		Source:        "polka",
+		Event:         polkaEventRenewed,
+		Payload:       payload,
+		ReceivedAt:    env.cfg.now(),
+		Status:        status,
+		NextAttemptAt: env.cfg.now(),
+	}
+	_, err = env.db.EnqueueWebhookEvent(event, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestWebhookReplayOnlyDeadEvents(t *testing.T) {
+	tests := []struct {
+		status string
+		code   int
+	}{
+		{status: inboxDead, code: http.StatusAccepted},
+		{status: inboxProcessed, code: http.StatusConflict},
+		{status: inboxPending, code: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			env := newTestEnv(t)
+			user := env.createUser(t, "user@example.com")
+			enqueueRenewal(t, env, "evt-1", user, tt.status)
+
+			router := chi.NewRouter()
+			router.Post("/admin/webhooks/{eventID}/replay", func(w http.ResponseWriter, r *http.Request) {
+				adminWebhookReplay(w, r, env.db, env.cfg)
+			})
+			rec := do(t, router, http.MethodPost, "/admin/webhooks/evt-1/replay", "", nil)
+			if rec.Code != tt.code {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tt.code)
+			}
+		})
+	}
+}
+
+func TestSubscriptionEventAppliedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	event := enqueueRenewal(t, env, "evt-1", user, inboxPending)
+
+	processInboxEvent(env.db, env.cfg, event)
+	first, err := GetUserById(env.db, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Subscription == nil {
+		t.Fatal("the renewal wasn't applied")
+	}
+
+	// a renewal without a period end extends the subscription, applying it twice would add two periods
+	processInboxEvent(env.db, env.cfg, event)
+	second, err := GetUserById(env.db, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Subscription.CurrentPeriodEnd.Equal(first.Subscription.CurrentPeriodEnd) {
+		t.Errorf("period end moved from %v to %v", first.Subscription.CurrentPeriodEnd, second.Subscription.CurrentPeriodEnd)
+	}
+	history, err := env.db.GetSubscriptionHistory(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("got %d subscription changes, want 1", len(history))
+	}
+}
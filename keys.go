@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// signingKey is one key of the keyring, its kid is the file name without ".pem".
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.PrivateKey
+	public    crypto.PublicKey
+	createdAt time.Time
+}
+
+// keyring holds the JWT signing keys loaded from dir. The newest key signs,
+// older keys keep verifying until every token they signed has expired.
+type keyring struct {
+	mux       *sync.RWMutex
+	dir       string
+	alg       string
+	keys      map[string]*signingKey
+	activeKid string
+}
+
+// newKeyring loads every PKCS#8 key in dir and generates one if there are none.
+// alg is "EdDSA" or "RS256" and is used for newly generated keys.
+func newKeyring(dir string, alg string) (*keyring, error) {
+	if alg != jwt.SigningMethodEdDSA.Alg() && alg != jwt.SigningMethodRS256.Alg() {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	ring := &keyring{
+		mux:  &sync.RWMutex{},
+		dir:  dir,
+		alg:  alg,
+		keys: map[string]*signingKey{},
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		ring.keys[key.kid] = key
+		active, found := ring.keys[ring.activeKid]
+		if !found || key.createdAt.After(active.createdAt) {
+			ring.activeKid = key.kid
+		}
+	}
+
+	if len(ring.keys) == 0 {
+		_, err = ring.Rotate(time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+func loadSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{
+		kid:       strings.TrimSuffix(filepath.Base(path), ".pem"),
+		createdAt: info.ModTime().UTC(),
+	}
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		key.method = jwt.SigningMethodEdDSA
+		key.private = private
+		key.public = private.Public()
+	case *rsa.PrivateKey:
+		key.method = jwt.SigningMethodRS256
+		key.private = private
+		key.public = &private.PublicKey
+	default:
+		return nil, errors.New("only Ed25519 and RSA keys are supported")
+	}
+	return key, nil
+}
+
+// Rotate generates a new key, writes it to the keyring directory and makes it the active key.
+func (ring *keyring) Rotate(now time.Time) (string, error) {
+	var private crypto.PrivateKey
+	var public crypto.PublicKey
+	var method jwt.SigningMethod
+	if ring.alg == jwt.SigningMethodRS256.Alg() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return "", err
+		}
+		private, public, method = rsaKey, &rsaKey.PublicKey, jwt.SigningMethodRS256
+	} else {
+		edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		private, public, method = edPrivate, edPublic, jwt.SigningMethodEdDSA
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	kid, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	kid = kid[:16]
+	path := filepath.Join(ring.dir, kid+".pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return "", err
+	}
+	err = os.Chtimes(path, now, now)
+	if err != nil {
+		return "", err
+	}
+
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+	ring.keys[kid] = &signingKey{
+		kid:       kid,
+		method:    method,
+		private:   private,
+		public:    public,
+		createdAt: now,
+	}
+	ring.activeKid = kid
+	return kid, nil
+}
+
+// Retire deletes keys that were replaced more than maxTokenLifetime ago,
+// no unexpired token can have been signed by them.
+func (ring *keyring) Retire(now time.Time, maxTokenLifetime time.Duration) error {
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+
+	keys := []*signingKey{}
+	for _, key := range ring.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].createdAt.Before(keys[j].createdAt)
+	})
+	// a key stopped signing when the key after it was created
+	for i := 0; i < len(keys)-1; i++ {
+		replacedAt := keys[i+1].createdAt
+		if keys[i].kid == ring.activeKid || now.Sub(replacedAt) <= maxTokenLifetime {
+			continue
+		}
+		err := os.Remove(filepath.Join(ring.dir, keys[i].kid+".pem"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		remaining := map[string]*signingKey{}
+		for kid, key := range ring.keys {
+			if kid != keys[i].kid {
+				remaining[kid] = key
+			}
+		}
+		ring.keys = remaining
+	}
+	return nil
+}
+
+// Sign signs the token with the active key and sets its kid header.
+func (ring *keyring) Sign(claims jwt.Claims) (string, error) {
+	ring.mux.RLock()
+	key := ring.keys[ring.activeKid]
+	ring.mux.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc finds the verification key named by the token's kid header and
+// makes sure the token was signed with that key's algorithm.
+func (ring *keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no kid header")
+	}
+	ring.mux.RLock()
+	key, found := ring.keys[kid]
+	ring.mux.RUnlock()
+	if !found {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing algorithm")
+	}
+	return key.public, nil
+}
+
+// jwk is a public key in JSON Web Key format.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func (ring *keyring) JWKS() []jwk {
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+
+	keys := []jwk{}
+	for _, key := range ring.keys {
+		entry := jwk{
+			Kid: key.kid,
+			Use: "sig",
+			Alg: key.method.Alg(),
+		}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			entry.Kty = "OKP"
+			entry.Crv = "Ed25519"
+			entry.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			entry.Kty = "RSA"
+			entry.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			entry.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		keys = append(keys, entry)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Kid < keys[j].Kid
+	})
+	return keys
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request, apiCfg *apiConfig) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, struct {
+		Keys []jwk `json:"keys"`
+	}{
+		Keys: apiCfg.keys.JWKS(),
+	})
+}
+
+// rotateKeys rotates the signing key once it is older than every and retires old keys.
+func rotateKeys(apiCfg *apiConfig, every time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := apiCfg.now()
+		ring := apiCfg.keys
+		ring.mux.RLock()
+		activeCreatedAt := ring.keys[ring.activeKid].createdAt
+		ring.mux.RUnlock()
+
+		if now.Sub(activeCreatedAt) >= every {
+			kid, err := ring.Rotate(now)
+			if err != nil {
+				log.Print("Error rotating signing key: " + err.Error())
+				continue
+			}
+			log.Printf("Rotated signing key, new kid: %s", kid)
+		}
+		err := ring.Retire(now, apiCfg.maxAccessTokenTTL+apiCfg.tokenLeeway)
+		if err != nil {
+			log.Print("Error retiring signing keys: " + err.Error())
+		}
+	}
+}
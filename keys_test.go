@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestKeyRotationAndRetirement(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	router := chi.NewRouter()
+	router.With(env.cfg.middlewareAuthRequired).Get("/api/entitlements", func(w http.ResponseWriter, r *http.Request) {
+		entitlementsGet(w, r, env.db, env.cfg)
+	})
+	router.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		jwksHandler(w, r, env.cfg)
+	})
+	jwks := func() []jwk {
+		t.Helper()
+		rec := do(t, router, http.MethodGet, "/.well-known/jwks.json", "", nil)
+		response := struct {
+			Keys []jwk `json:"keys"`
+		}{}
+		decodeBody(t, rec, &response)
+		return response.Keys
+	}
+	accepted := func(token string) bool {
+		return do(t, router, http.MethodGet, "/api/entitlements", token, nil).Code == http.StatusOK
+	}
+
+	oldToken := env.accessToken(t, user)
+	// key ages come from the key files, so rotation uses the real clock
+	rotatedAt := time.Now().UTC().Add(time.Minute)
+	newKid, err := env.cfg.keys.Rotate(rotatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken := env.accessToken(t, user)
+	if !accepted(oldToken) || !accepted(newToken) {
+		t.Fatal("tokens of the old and the new key should both be accepted after a rotation")
+	}
+	if keys := jwks(); len(keys) != 2 {
+		t.Fatalf("got %d keys in the JWKS, want both", len(keys))
+	}
+
+	lifetime := env.cfg.maxAccessTokenTTL + env.cfg.tokenLeeway
+	err = env.cfg.keys.Retire(rotatedAt.Add(lifetime), lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accepted(oldToken) {
+		t.Fatal("the old key was retired while its tokens could still be valid")
+	}
+
+	err = env.cfg.keys.Retire(rotatedAt.Add(lifetime+time.Second), lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted(oldToken) {
+		t.Error("a token signed by a retired key was accepted")
+	}
+	if !accepted(newToken) {
+		t.Error("a token signed by the active key was rejected")
+	}
+	keys := jwks()
+	if len(keys) != 1 || keys[0].Kid != newKid {
+		t.Errorf("got JWKS %+v, want only %s", keys, newKid)
+	}
+
+	// the retired key is gone from disk too
+	reloaded, err := newKeyring(env.cfg.keys.dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.keys) != 1 || reloaded.activeKid != newKid {
+		t.Errorf("reloaded keyring has %d keys, active %s, want only %s", len(reloaded.keys), reloaded.activeKid, newKid)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// failed logins allowed before the backoff starts
+	accountFreeAttempts = 5
+	ipFreeAttempts      = 20
+
+	// the first lockout lasts lockoutBase and doubles with every further failure
+	lockoutBase = 30 * time.Second
+	lockoutMax  = time.Hour
+
+	// counters are forgotten once nothing has failed for this long
+	failureMemory = 24 * time.Hour
+)
+
+var errBadCredentials = errors.New("incorrect email or password")
+
+// loginLockedError is returned while an account or address is locked out.
+type loginLockedError struct {
+	retryAfter time.Duration
+}
+
+func (err loginLockedError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// addresses is set on account counters, the addresses the failures came from
+	addresses map[string]bool
+}
+
+// loginThrottle counts failed logins per account and per client address and locks
+// them out with exponential backoff. Accounts are keyed by the email that was tried,
+// so emails without an account are throttled the same way as real ones.
+type loginThrottle struct {
+	mux      *sync.Mutex
+	accounts map[string]*loginFailures
+	ips      map[string]*loginFailures
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		mux:      &sync.Mutex{},
+		accounts: map[string]*loginFailures{},
+		ips:      map[string]*loginFailures{},
+	}
+}
+
+func accountKey(email string) string {
+	return normalizeEmail(email)
+}
+
+// Check returns a loginLockedError if the account or the address may not try to log in yet.
+func (throttle *loginThrottle) Check(email string, ip string, now time.Time) error {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+
+	lockedUntil := time.Time{}
+	if failures, found := throttle.accounts[accountKey(email)]; found {
+		lockedUntil = failures.lockedUntil
+	}
+	if failures, found := throttle.ips[ip]; found && failures.lockedUntil.After(lockedUntil) {
+		lockedUntil = failures.lockedUntil
+	}
+	if lockedUntil.After(now) {
+		return loginLockedError{retryAfter: lockedUntil.Sub(now)}
+	}
+	return nil
+}
+
+// Failure records a failed attempt for the account and the address.
+func (throttle *loginThrottle) Failure(email string, ip string, now time.Time) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+
+	account := recordFailure(throttle.accounts, accountKey(email), accountFreeAttempts, now)
+	account.addresses[ip] = true
+	recordFailure(throttle.ips, ip, ipFreeAttempts, now)
+}
+
+func recordFailure(counters map[string]*loginFailures, key string, freeAttempts int, now time.Time) *loginFailures {
+	failures, found := counters[key]
+	if !found || now.Sub(failures.lastFailure) > failureMemory {
+		failures = &loginFailures{addresses: map[string]bool{}}
+		counters[key] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count < freeAttempts {
+		return failures
+	}
+	// 30s, 1m, 2m, 4m ... up to lockoutMax
+	backoff := lockoutMax
+	if exponent := failures.count - freeAttempts; exponent < 16 {
+		backoff = lockoutBase << exponent
+		if backoff > lockoutMax {
+			backoff = lockoutMax
+		}
+	}
+	failures.lockedUntil = now.Add(backoff)
+	return failures
+}
+
+// Success clears the failed logins of an account after a successful login. Addresses
+// keep their count so logging into one account doesn't reset guessing against others.
+func (throttle *loginThrottle) Success(email string) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+
+	delete(throttle.accounts, accountKey(email))
+}
+
+// Unlock is the admin unlock, it clears the failed logins of an account and of the
+// addresses they came from.
+func (throttle *loginThrottle) Unlock(email string) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+
+	key := accountKey(email)
+	if failures, found := throttle.accounts[key]; found {
+		for ip := range failures.addresses {
+			delete(throttle.ips, ip)
+		}
+	}
+	delete(throttle.accounts, key)
+}
+
+func (throttle *loginThrottle) prune(now time.Time) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+
+	throttle.accounts = recentFailures(throttle.accounts, now)
+	throttle.ips = recentFailures(throttle.ips, now)
+}
+
+func recentFailures(counters map[string]*loginFailures, now time.Time) map[string]*loginFailures {
+	remaining := map[string]*loginFailures{}
+	for key, failures := range counters {
+		if now.Sub(failures.lastFailure) <= failureMemory || failures.lockedUntil.After(now) {
+			remaining[key] = failures
+		}
+	}
+	return remaining
+}
+
+// pruneRateLimits periodically forgets failure counters and rate limits that have gone quiet.
+func pruneRateLimits(apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := apiCfg.now()
+		apiCfg.loginThrottle.prune(now)
+		apiCfg.magicLinkIPLimiter.prune(now)
+		apiCfg.magicLinkEmailLimiter.prune(now)
+		apiCfg.passwordResetIPLimiter.prune(now)
+		apiCfg.passwordResetEmailLimiter.prune(now)
+		apiCfg.apiRateLimiter.prune(now)
+		apiCfg.plans.prune(now)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// writeLoginError answers a failed login without saying whether the account exists.
+func writeLoginError(w http.ResponseWriter, err error) {
+	var locked loginLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.retryAfter.Seconds()))))
+		http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, errBadCredentials.Error(), http.StatusUnauthorized)
+}
+
+// adminUnlockUser clears the failed logins of a locked out account.
+func adminUnlockUser(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	user, ok := adminUserFromURL(w, r, db)
+	if !ok {
+		return
+	}
+	apiCfg.loginThrottle.Unlock(user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
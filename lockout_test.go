@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleUnlock(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lockOut := func() *loginThrottle {
+		throttle := newLoginThrottle()
+		for i := 0; i < ipFreeAttempts; i++ {
+			throttle.Failure("user@example.com", "203.0.113.7", now)
+		}
+		return throttle
+	}
+
+	throttle := lockOut()
+	if throttle.Check("user@example.com", "198.51.100.1", now) == nil {
+		t.Fatal("the account should be locked")
+	}
+	if throttle.Check("other@example.com", "203.0.113.7", now) == nil {
+		t.Fatal("the address should be locked")
+	}
+
+	// a successful login only clears the account
+	throttle.Success("user@example.com")
+	if err := throttle.Check("user@example.com", "198.51.100.1", now); err != nil {
+		t.Errorf("account after a successful login: %v", err)
+	}
+	if throttle.Check("other@example.com", "203.0.113.7", now) == nil {
+		t.Error("the address should still be locked after a successful login")
+	}
+
+	// the admin unlock clears the account and the addresses that failed against it
+	throttle = lockOut()
+	throttle.Failure("other@example.com", "198.51.100.1", now)
+	throttle.Unlock("User@Example.com")
+	if err := throttle.Check("user@example.com", "203.0.113.7", now); err != nil {
+		t.Errorf("account and address after unlock: %v", err)
+	}
+	if _, found := throttle.ips["198.51.100.1"]; !found {
+		t.Error("an unrelated address was cleared")
+	}
+}
@@ -2,12 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
-	"strconv"
-	"time"
-
-	"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func userLogin(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
@@ -24,76 +20,122 @@ func userLogin(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig
 	// now the content of the request body is in bodyFetched variable !
 	if err != nil {
 		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
 	}
 
-	// first fetch the user with email, then compare the password !
-	findUser, err := GetUser(db, bodyFetched.Email)
+	findUser, err := authenticateUser(db, apiCfg, clientIP(r), bodyFetched.Email, bodyFetched.Password)
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
 
+	// the password is only the first factor, the tokens come from /api/login/2fa
+	if findUser.TOTPEnabled {
+		writeTwoFactorChallenge(w, apiCfg, findUser)
+		return
+	}
+	completeLogin(w, r, db, apiCfg, findUser, bodyFetched.Expires_In_Seconds)
+}
+
+// completeLogin starts a session for a user who has passed every login step and
+// writes their access and refresh tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig, findUser User, expiresInSeconds int) {
+	// logging in before a deleted account is purged restores it
+	err := db.RestoreUser(findUser.Id)
 	if err != nil {
-		http.Error(w, "user not found", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(findUser.Password), []byte(bodyFetched.Password))
+	// users who must use two-factor authentication get nothing but enrollment until they do
+	if twoFactorRequired(findUser) && !findUser.TOTPEnabled {
+		writeEnrollmentToken(w, apiCfg, findUser)
+		return
+	}
 
-	if err == nil {
+	session, err := createSession(db, apiCfg, r, findUser.Id, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		var accessTokenExpiration int64 = int64(time.Hour)
-		var refreshTokenExpiration int64 = int64(time.Hour * 24 * 60)
+	accessTokenString, err := issueToken(apiCfg, findUser.Id, apiCfg.accessTokenTTLFor(expiresInSeconds), tokenClaims{
+		TokenType: tokenTypeAccess,
+		SessionId: session.Id,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-			Issuer:    "chirpy-access",
-			IssuedAt:  time.Now().UTC().Unix(),
-			ExpiresAt: accessTokenExpiration,
-			Subject:   strconv.Itoa(findUser.Id),
-		})
-		accessTokenString, err := accessToken.SignedString(apiCfg.jwtSecret)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+	refreshTokenString, err := issueRefreshToken(db, apiCfg, findUser.Id, session.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-			Issuer:    "chirpy-refresh",
-			IssuedAt:  time.Now().UTC().Unix(),
-			ExpiresAt: refreshTokenExpiration,
-			Subject:   strconv.Itoa(findUser.Id),
-		})
-		refreshTokenString, err := refreshToken.SignedString(apiCfg.jwtSecret)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+	// correct password entered ! has been found !
+	// write response !
+	userWithoutPassword := struct {
+		Id           int    `json:"id"`
+		Email        string `json:"email"`
+		Token  string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		Is_Chirpy_Red bool `json:"is_chirpy_red"`
+	}{
+		Id:           findUser.Id,
+		Email:        findUser.Email,
+		Token:  accessTokenString,
+		RefreshToken: refreshTokenString,
+		Is_Chirpy_Red: findUser.IsChirpyRed(apiCfg.now()),
+	}
 
-		// correct password entered ! has been found !
-		// write response !
-		userWithoutPassword := struct {
-			Id           int    `json:"id"`
-			Email        string `json:"email"`
-			Token  string `json:"token"`
-			RefreshToken string `json:"refresh_token"`
-			Is_Chirpy_Red bool `json:"is_chirpy_red"`
-		}{
-			Id:           findUser.Id,
-			Email:        findUser.Email,
-			Token:  accessTokenString,
-			RefreshToken: refreshTokenString,
-			Is_Chirpy_Red: findUser.Is_Chirpy_Red,
-		}
-		if err != nil {
-			return
-		}
+	// Marshal the response into JSON
+	responseJSON, err := json.Marshal(userWithoutPassword)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
-		// Marshal the response into JSON
-		responseJSON, err := json.Marshal(userWithoutPassword)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	// Set the response headers and write the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
+}
 
-		// Set the response headers and write the response
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(responseJSON)
+// authenticateUser checks an email and password pair and returns the user they belong to.
+// Failures are counted against the email and the client address, and unknown emails
+// take as long and fail the same way as wrong passwords.
+func authenticateUser(db *DB, apiCfg *apiConfig, ip string, email string, password string) (User, error) {
+	now := apiCfg.now()
+	err := apiCfg.loginThrottle.Check(email, ip, now)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, lookupErr := GetUser(db, email)
+	passwordHash := apiCfg.passwords.dummyHash
+	if lookupErr == nil {
+		passwordHash = user.Password
+	}
+	err = apiCfg.passwords.Compare(passwordHash, password)
+	if err != nil || lookupErr != nil {
+		apiCfg.loginThrottle.Failure(email, ip, now)
+		return User{}, errBadCredentials
+	}
+	apiCfg.loginThrottle.Success(email)
 
-	} else {
-		http.Error(w, "password does not match !", http.StatusUnauthorized)
+	// the password is only known right now, so this is the moment to move it to the current scheme
+	if apiCfg.passwords.NeedsRehash(user.Password) {
+		newHash, err := apiCfg.passwords.Hash(password)
+		if err == nil {
+			err = db.SetPassword(user.Id, newHash)
+		}
+		if err != nil {
+			log.Print("Error rehashing password: " + err.Error())
+		} else {
+			user.Password = newHash
+		}
 	}
+	return user, nil
 }
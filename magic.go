@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeMagicLogin = "magic_login"
+	magicLinkTTL      = 15 * time.Minute
+
+	// magicLinkCookie holds the secret the link is bound to, so a link only logs in
+	// the browser that asked for it
+	magicLinkCookie = "chirpy_magic_link"
+
+	magicLinksPerEmail = 3
+	magicLinksPerIP    = 10
+	magicLinkWindow    = 15 * time.Minute
+)
+
+// magicLinkRequest always answers 202 so it can't be used to find out which emails have accounts.
+func magicLinkRequest(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		Email string `json:"email"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	// emails are limited whether or not they have an account
+	now := apiCfg.now()
+	allowed, retryAfter := apiCfg.magicLinkIPLimiter.Allow(clientIP(r), now)
+	if allowed {
+		allowed, retryAfter = apiCfg.magicLinkEmailLimiter.Allow(accountKey(bodyFetched.Email), now)
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "too many login links requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	binding, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// the cookie is set even when there is no account, so the response looks the same
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    binding,
+		Path:     "/api/login/magic",
+		MaxAge:   int(magicLinkTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(apiCfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	sendInBackground("magic link", func() error {
+		user, err := GetUser(db, bodyFetched.Email)
+		if err != nil {
+			return nil
+		}
+		return sendMagicLinkEmail(db, apiCfg, user, binding)
+	})
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func sendMagicLinkEmail(db *DB, apiCfg *apiConfig, user User, binding string) error {
+	rawToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+	err = db.SaveOneTimeToken(hashToken(rawToken), OneTimeToken{
+		UserId:      user.Id,
+		Purpose:     purposeMagicLogin,
+		ExpiresAt:   apiCfg.now().Add(magicLinkTTL),
+		BindingHash: hashToken(binding),
+	})
+	if err != nil {
+		return err
+	}
+	link := apiCfg.baseURL + "/api/login/magic/verify?token=" + url.QueryEscape(rawToken)
+	return apiCfg.mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Your Chirpy login link",
+		Body:    "Open this link in the same browser you asked for it from to log in to Chirpy:\n\n" + link + "\n\nThe link expires in 15 minutes and works once. If you didn't ask for it, you can ignore this email.",
+	})
+}
+
+// magicLinkVerify logs in with a link from magicLinkRequest. The binding cookie is
+// checked before the token is used up, so a link scanner opening the link doesn't burn it.
+func magicLinkVerify(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	tokenHash := hashToken(r.URL.Query().Get("token"))
+	token, err := db.GetOneTimeToken(tokenHash)
+	if err != nil || token.Purpose != purposeMagicLogin {
+		http.Error(w, errInvalidToken.Error(), http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(magicLinkCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(cookie.Value)), []byte(token.BindingHash)) != 1 {
+		http.Error(w, "open the link in the browser that asked for it", http.StatusForbidden)
+		return
+	}
+	token, err = db.ConsumeOneTimeToken(tokenHash, purposeMagicLogin, apiCfg.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   magicLinkCookie,
+		Path:   "/api/login/magic",
+		MaxAge: -1,
+	})
+
+	user, err := GetUserById(db, token.UserId)
+	if err != nil {
+		http.Error(w, errInvalidToken.Error(), http.StatusBadRequest)
+		return
+	}
+	// the link could only be opened from the inbox, which proves the address
+	if !user.EmailVerified {
+		err = db.SetEmailVerified(user.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// a link replaces the password, not the second factor
+	if user.TOTPEnabled {
+		writeTwoFactorChallenge(w, apiCfg, user)
+		return
+	}
+	completeLogin(w, r, db, apiCfg, user, 0)
+}
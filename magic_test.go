@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func magicRouter(env *testEnv) http.Handler {
+	r := chi.NewRouter()
+	r.Post("/api/login/magic", func(w http.ResponseWriter, r *http.Request) {
+		magicLinkRequest(w, r, env.db, env.cfg)
+	})
+	r.Get("/api/login/magic/verify", func(w http.ResponseWriter, r *http.Request) {
+		magicLinkVerify(w, r, env.db, env.cfg)
+	})
+	return r
+}
+
+// requestMagicLink asks for a link and returns the binding cookie and the token from the email.
+func requestMagicLink(t *testing.T, env *testEnv, router http.Handler, email string) (*http.Cookie, string) {
+	t.Helper()
+	rec := do(t, router, http.MethodPost, "/api/login/magic", "", map[string]string{"email": email})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("request link: got %d %s", rec.Code, rec.Body)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == magicLinkCookie {
+			return cookie, tokenFromEmail(t, env.mailer.Last(t, email))
+		}
+	}
+	t.Fatal("no binding cookie was set")
+	return nil, ""
+}
+
+func openMagicLink(router http.Handler, token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/login/magic/verify?token="+token, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMagicLinkIsBoundToTheBrowser(t *testing.T) {
+	env := newTestEnv(t)
+	router := magicRouter(env)
+	env.createUser(t, "user@example.com")
+	cookie, token := requestMagicLink(t, env, router, "user@example.com")
+
+	if rec := openMagicLink(router, token, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("without the cookie: got %d, want 403", rec.Code)
+	}
+	other := &http.Cookie{Name: magicLinkCookie, Value: "another browser"}
+	if rec := openMagicLink(router, token, other); rec.Code != http.StatusForbidden {
+		t.Errorf("with another browser's cookie: got %d, want 403", rec.Code)
+	}
+
+	// the failed attempts didn't use the link up
+	rec := openMagicLink(router, token, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("with the cookie: got %d %s", rec.Code, rec.Body)
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	decodeBody(t, rec, &response)
+	if _, err := parseToken(env.cfg, response.Token, tokenTypeAccess); err != nil {
+		t.Errorf("access token from the link: %v", err)
+	}
+}
+
+func TestMagicLinkWorksOnce(t *testing.T) {
+	env := newTestEnv(t)
+	router := magicRouter(env)
+	env.createUser(t, "user@example.com")
+	cookie, token := requestMagicLink(t, env, router, "user@example.com")
+
+	if rec := openMagicLink(router, token, cookie); rec.Code != http.StatusOK {
+		t.Fatalf("first use: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := openMagicLink(router, token, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("second use: got %d, want 400", rec.Code)
+	}
+}
+
+func TestMagicLinkExpires(t *testing.T) {
+	env := newTestEnv(t)
+	router := magicRouter(env)
+	env.createUser(t, "user@example.com")
+	cookie, token := requestMagicLink(t, env, router, "user@example.com")
+
+	env.clock.Advance(magicLinkTTL + time.Second)
+	if rec := openMagicLink(router, token, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("expired link: got %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails, the implementation is picked from the environment in newMailer.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// smtpMailer delivers through an SMTP server, auth is skipped when no username is set
+// so a local fake server can be used in tests.
+type smtpMailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, auth, sender.Address, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// sendInBackground runs send after the response has been written, so how long a request
+// takes doesn't tell whether the email it was given has an account.
+func sendInBackground(what string, send func() error) {
+	go func() {
+		err := send()
+		if err != nil {
+			log.Print("Error sending " + what + " email: " + err.Error())
+		}
+	}()
+}
+
+// fileMailer writes every email as a .eml file in dir.
+type fileMailer struct {
+	dir  string
+	from string
+	mux  *sync.Mutex
+	sent int
+}
+
+func (m *fileMailer) Send(msg Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	err := os.MkdirAll(m.dir, 0755)
+	if err != nil {
+		return err
+	}
+	m.sent++
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UTC().UnixNano(), m.sent)
+	return os.WriteFile(filepath.Join(m.dir, name), formatMessage(m.from, msg), 0644)
+}
+
+// logMailer only logs emails, it is the default for local development.
+type logMailer struct{}
+
+func (m logMailer) Send(msg Message) error {
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// newMailer builds a Mailer from MAILER ("smtp", "file" or "log") and its settings.
+func newMailer() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@chirpy.local>"
+	}
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		return &smtpMailer{
+			addr:     os.Getenv("SMTP_ADDR"),
+			from:     from,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &fileMailer{dir: dir, from: from, mux: &sync.Mutex{}}
+	default:
+		return logMailer{}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpEnvelope is what the fake SMTP server received for one message.
+type smtpEnvelope struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts a single SMTP session on a local port and sends what it
+// received on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpEnvelope) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan smtpEnvelope, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		envelope := smtpEnvelope{}
+		text.PrintfLine("220 localhost fake SMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				text.PrintfLine("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				envelope.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				text.PrintfLine("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				envelope.to = append(envelope.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				text.PrintfLine("250 OK")
+			case command == "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				envelope.data = string(data)
+				text.PrintfLine("250 OK")
+			case command == "QUIT":
+				text.PrintfLine("221 bye")
+				received <- envelope
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	mailer := &smtpMailer{addr: addr, from: "Chirpy <no-reply@chirpy.test>"}
+
+	err := mailer.Send(Message{
+		To:      "user@example.com",
+		Subject: "Reset your Chirpy password",
+		Body:    "Use this link:\nhttp://chirpy.test/reset?token=abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := <-received
+
+	if envelope.from != "no-reply@chirpy.test" {
+		t.Errorf("got MAIL FROM %q, want the bare address", envelope.from)
+	}
+	if len(envelope.to) != 1 || envelope.to[0] != "user@example.com" {
+		t.Errorf("got RCPT TO %v", envelope.to)
+	}
+	for _, want := range []string{
+		"From: Chirpy <no-reply@chirpy.test>\n",
+		"To: user@example.com\n",
+		"Subject: Reset your Chirpy password\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+		"\nUse this link:\nhttp://chirpy.test/reset?token=abc",
+	} {
+		if !strings.Contains(envelope.data, want) {
+			t.Errorf("message %q doesn't contain %q", envelope.data, want)
+		}
+	}
+}
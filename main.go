@@ -1,9 +1,14 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 )
@@ -12,27 +17,185 @@ type Chirp struct {
 	Id   int    `json:"id"`
 	Body string `json:"body"`
 	AuthorId int `json:"author_id"`
+	MediaIds []string `json:"media_ids,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// EditedAt is set once the author has edited the chirp
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// DeletedAt is set while the chirp is deleted but can still be restored
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type User struct {
 	Id   int    `json:"id"`
 	Email string `json:"email"`
 	Password string `json:"password"`
-	Is_Chirpy_Red bool `json:"is_chirpy_red"`
+	Handle        string    `json:"handle"`
+	DisplayName   string    `json:"display_name"`
+	Bio           string    `json:"bio"`
+	AvatarMediaId string    `json:"avatar_media_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	// DeletedAt is set while the account is deleted, it is purged once the retention period is over
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	EmailVerified       bool       `json:"email_verified"`
+	// TOTPSecret is the base32 secret, it is set at enrollment but only used once TOTPEnabled
+	TOTPSecret   string `json:"totp_secret,omitempty"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Require2FA means the user can't get full tokens until they enroll in TOTP
+	Require2FA bool `json:"require_2fa"`
+	// Roles grant permissions, see rolePermissions
+	Roles []string `json:"roles,omitempty"`
+	// Subscription is the Chirpy Red membership, nil for users who never subscribed
+	Subscription *Subscription `json:"subscription,omitempty"`
+}
+
+// Session is one login of a user, its id is also the family id of its refresh tokens.
+type Session struct {
+	Id         string    `json:"id"`
+	UserId     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Revoked    bool      `json:"revoked"`
+	// ClientId is set for the sessions of OAuth apps
+	ClientId string `json:"client_id,omitempty"`
+}
+
+// RefreshToken is stored under the hash of the opaque token handed to the client.
+// Every refresh rotates the token, the new one joins the family of the old one.
+type RefreshToken struct {
+	UserId    int        `json:"user_id"`
+	FamilyId  string     `json:"family_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	Revoked   bool       `json:"revoked"`
+}
+
+// APIToken is a personal access token, stored under the hash of the secret
+// that was shown to the user once.
+type APIToken struct {
+	Id         string     `json:"id"`
+	UserId     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// OAuthClient is a third-party app registered by a user, confidential clients
+// authenticate with a secret that is stored hashed.
+type OAuthClient struct {
+	Id           string    `json:"id"`
+	OwnerId      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuthCode is an OAuth authorization code, stored under its hash until it is exchanged.
+type AuthCode struct {
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// OneTimeToken is stored under the hash of the token that was emailed to the user.
+type OneTimeToken struct {
+	UserId    int       `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	ExpiresAt time.Time `json:"expires_at"`
+	NewEmail  string    `json:"new_email,omitempty"`
+	// BindingHash is the hash of a cookie the token only works together with
+	BindingHash string `json:"binding_hash,omitempty"`
+}
+
+type Follow struct {
+	FollowerId int `json:"follower_id"`
+	FolloweeId int `json:"followee_id"`
+}
+
+// durationFromEnv parses a duration such as "15m" from the environment, falling back on errors.
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func intFromEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// publicFiles only lets the file server serve the home page and assets. The working
+// directory also holds the database and the source, which must never be served.
+func publicFiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" && !strings.HasPrefix(r.URL.Path, "/assets/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func main() {
 	godotenv.Load()
-	JWTSecret := os.Getenv("JWT_SECRET")
-	POLKAkey := os.Getenv("POLKA_KEY")
+
+	// "chirpy users ..." manages the database instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		DB, err := NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runUsersCommand(DB, os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	debug := flag.Bool("debug", false, "start with an empty database")
+	flag.Parse()
+	if *debug {
+		err := os.Remove("database.json")
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+
+	// POLKA_KEYS is a comma separated list so a new key can be added before the old one is dropped
+	POLKAkeys := []string{}
+	for _, key := range strings.Split(os.Getenv("POLKA_KEYS")+","+os.Getenv("POLKA_KEY"), ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			POLKAkeys = append(POLKAkeys, key)
+		}
+	}
 	const port = "8080"
 	DB, err := NewDB("")
 	if err != nil {
 		return
 	}
+	DB.events = newChirpBus()
 	r := chi.NewRouter()
 	apiRouter := chi.NewRouter()
 	adminRouter := chi.NewRouter()
+	oauthRouter := chi.NewRouter()
 	corsMux := middlewareCors(r) // it wraps mux with the middlewareCors, this ensure that all request first passes through CORS MIDDLEWARE
 
 	var srv http.Server   // we create a variable srv which is of type http.Server !
@@ -41,49 +204,271 @@ func main() {
 
 	var apiCfg apiConfig
 	apiCfg.fileserverHits = 0
-	apiCfg.jwtSecret = []byte(JWTSecret)
-	apiCfg.polkaKey = POLKAkey
+	apiCfg.db = DB
+	apiCfg.polkaKeys = POLKAkeys
+	apiCfg.polkaTolerance = durationFromEnv("POLKA_TOLERANCE", 5*time.Minute)
+	apiCfg.webhookWake = make(chan struct{}, 1)
+	apiCfg.deliveryWake = make(chan struct{}, 1)
+	apiCfg.webhookClient = &http.Client{Timeout: deliveryTimeout}
+	apiCfg.subscriptionGrace = time.Duration(intFromEnv("SUBSCRIPTION_GRACE_DAYS", 3)) * 24 * time.Hour
+	apiCfg.defaultRetention = Retention{
+		ChirpDays: intFromEnv("CHIRP_RETENTION_DAYS", 7),
+		UserDays:  intFromEnv("DELETION_GRACE_DAYS", 30),
+	}
+	apiCfg.exports = newExportStore()
+	apiCfg.mailer = newMailer()
+	apiCfg.accessTokenTTL = durationFromEnv("ACCESS_TOKEN_TTL", time.Hour)
+	apiCfg.maxAccessTokenTTL = durationFromEnv("MAX_ACCESS_TOKEN_TTL", 24*time.Hour)
+	apiCfg.refreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 60*24*time.Hour)
+	apiCfg.tokenLeeway = durationFromEnv("TOKEN_LEEWAY", 30*time.Second)
+	apiCfg.now = func() time.Time { return time.Now().UTC() }
+	apiCfg.baseURL = os.Getenv("BASE_URL")
+	if apiCfg.baseURL == "" {
+		apiCfg.baseURL = "http://localhost:" + port
+	}
+
+	apiCfg.revocations, err = newRevocationList(DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	apiCfg.loginThrottle = newLoginThrottle()
+	apiCfg.plans, err = newPlanCatalog(DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiCfg.apiRateLimiter = newRateLimiter(0, time.Minute)
+	apiCfg.magicLinkIPLimiter = newRateLimiter(magicLinksPerIP, magicLinkWindow)
+	apiCfg.magicLinkEmailLimiter = newRateLimiter(magicLinksPerEmail, magicLinkWindow)
+	apiCfg.passwordResetIPLimiter = newRateLimiter(passwordResetsPerIP, passwordResetWindow)
+	apiCfg.passwordResetEmailLimiter = newRateLimiter(passwordResetsPerEmail, passwordResetWindow)
+
+	apiCfg.passwords, err = passwordHashingFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the bundled list may be left out, but a list the operator configured must exist
+	breachedPasswordsFile := os.Getenv("BREACHED_PASSWORDS_FILE")
+	breachedPasswordsRequired := breachedPasswordsFile != ""
+	if !breachedPasswordsRequired {
+		breachedPasswordsFile = "assets/breached-passwords.txt"
+	}
+	breachedPasswords, err := loadBreachedPasswords(breachedPasswordsFile, breachedPasswordsRequired)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiCfg.passwordPolicy = passwordPolicy{
+		minLength: intFromEnv("PASSWORD_MIN_LENGTH", 8),
+		maxLength: 1024,
+		breached:  breachedPasswords,
+	}
+
+	// the working directory is served to the web, so the private keys live outside of it
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		keysDir = filepath.Join(configDir, "chirpy", "keys")
+	}
+	signingAlg := os.Getenv("JWT_SIGNING_ALG")
+	if signingAlg == "" {
+		signingAlg = "EdDSA"
+	}
+	apiCfg.keys, err = newKeyring(keysDir, signingAlg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go purgeTrash(DB, &apiCfg, time.Hour)
+	go lapseSubscriptions(DB, &apiCfg, 10*time.Minute)
+	go publishScheduledChirps(DB, &apiCfg, 30*time.Second)
+	go processWebhookInbox(DB, &apiCfg, 15*time.Second)
+	go deliverWebhooks(DB, &apiCfg, 15*time.Second)
+	go pruneRevocations(DB, &apiCfg, 10*time.Minute)
+	go rotateKeys(&apiCfg, durationFromEnv("JWT_KEY_ROTATION", 30*24*time.Hour), time.Hour)
+	go pruneRateLimits(&apiCfg, time.Hour)
 
 	fileHandler := http.FileServer(http.Dir("."))
 
-	r.Mount("/", apiCfg.middlewareMetricsInc(fileHandler))
-	apiRouter.Get("/metrics", apiCfg.metricsHandler)
+	r.Mount("/", apiCfg.middlewareMetricsInc(publicFiles(fileHandler)))
+	r.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		jwksHandler(w, r, &apiCfg)
+	})
+	apiRouter.With(apiCfg.middlewarePermission(permAdminMetrics)).Get("/metrics", apiCfg.metricsHandler)
 	apiRouter.Get("/healthz", handlerReadiness)
 
-	apiRouter.Get("/chirps", func(w http.ResponseWriter, r *http.Request) {
+	apiRouter.With(apiCfg.middlewareAuthOptional).Get("/chirps", func(w http.ResponseWriter, r *http.Request) {
 		chirpsGet(w, r, DB)
 	})
 
-	apiRouter.Post("/chirps", func(w http.ResponseWriter, r *http.Request) {
+	apiRouter.With(apiCfg.middlewareScope(scopeChirpsWrite)).Post("/chirps", func(w http.ResponseWriter, r *http.Request) {
 		chirpsPost(w, r, DB, &apiCfg)
 	})
 
-	apiRouter.Get("/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
+	apiRouter.With(apiCfg.middlewareAuthOptional).Get("/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
 		chirpsGetById(w, r, DB)
 	})
 
+	apiRouter.With(apiCfg.middlewareAuthOptional).Get("/stream/chirps", func(w http.ResponseWriter, r *http.Request) {
+		chirpsStream(w, r, DB, &apiCfg)
+	})
+
 	apiRouter.Post("/users",func(w http.ResponseWriter, r *http.Request) {
-		userPost(w,r,DB)
+		userPost(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Get("/users/verify",func(w http.ResponseWriter, r *http.Request) {
+		verifyEmail(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Post("/users/verify/resend",func(w http.ResponseWriter, r *http.Request) {
+		resendVerification(w,r,DB,&apiCfg)
 	})
 
-	apiRouter.Put("/users",func(w http.ResponseWriter, r *http.Request) {
+	apiRouter.Post("/password/forgot",func(w http.ResponseWriter, r *http.Request) {
+		passwordForgot(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Post("/password/reset",func(w http.ResponseWriter, r *http.Request) {
+		passwordReset(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Put("/users",func(w http.ResponseWriter, r *http.Request) {
 		usersPut(w,r,DB,&apiCfg)
 	})
 
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Patch("/users",func(w http.ResponseWriter, r *http.Request) {
+		usersPut(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Get("/users/email/confirm",func(w http.ResponseWriter, r *http.Request) {
+		confirmEmailChange(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Delete("/users",func(w http.ResponseWriter, r *http.Request) {
+		accountDelete(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileRead)).Get("/users/me/export",func(w http.ResponseWriter, r *http.Request) {
+		accountExport(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Put("/users/profile",func(w http.ResponseWriter, r *http.Request) {
+		profilePut(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Get("/users/{userID}",func(w http.ResponseWriter, r *http.Request) {
+		profileGetById(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Post("/users/{userID}/follow",func(w http.ResponseWriter, r *http.Request) {
+		followPost(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeProfileWrite)).Delete("/users/{userID}/follow",func(w http.ResponseWriter, r *http.Request) {
+		followDelete(w,r,DB)
+	})
+
+	apiRouter.Get("/users/handle/{handle}",func(w http.ResponseWriter, r *http.Request) {
+		profileGetByHandle(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Get("/sessions",func(w http.ResponseWriter, r *http.Request) {
+		sessionsGet(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Delete("/sessions/{sessionID}",func(w http.ResponseWriter, r *http.Request) {
+		sessionDelete(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Post("/logout-all",func(w http.ResponseWriter, r *http.Request) {
+		logoutAll(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Post("/tokens",func(w http.ResponseWriter, r *http.Request) {
+		apiTokensPost(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Get("/tokens",func(w http.ResponseWriter, r *http.Request) {
+		apiTokensGet(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Delete("/tokens/{tokenID}",func(w http.ResponseWriter, r *http.Request) {
+		apiTokenDelete(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Post("/oauth/clients",func(w http.ResponseWriter, r *http.Request) {
+		oauthClientsPost(w,r,DB,&apiCfg)
+	})
+
 	apiRouter.Post("/login",func(w http.ResponseWriter, r *http.Request) {
 		userLogin(w,r,DB,&apiCfg)
 	})
 
+	apiRouter.Post("/login/magic",func(w http.ResponseWriter, r *http.Request) {
+		magicLinkRequest(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Get("/login/magic/verify",func(w http.ResponseWriter, r *http.Request) {
+		magicLinkVerify(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.Post("/login/2fa",func(w http.ResponseWriter, r *http.Request) {
+		loginTwoFactor(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareEnrollment).Post("/2fa/enroll",func(w http.ResponseWriter, r *http.Request) {
+		twoFactorEnroll(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareEnrollment).Get("/2fa/qr.png",func(w http.ResponseWriter, r *http.Request) {
+		twoFactorQRCode(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareEnrollment).Post("/2fa/confirm",func(w http.ResponseWriter, r *http.Request) {
+		twoFactorConfirm(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareFullAccess).Post("/2fa/disable",func(w http.ResponseWriter, r *http.Request) {
+		twoFactorDisable(w,r,DB,&apiCfg)
+	})
+
 	apiRouter.Post("/refresh",func(w http.ResponseWriter, r *http.Request) {
 		refresh(w,r,DB, &apiCfg)
 	})
 
 	apiRouter.Post("/revoke",func(w http.ResponseWriter, r *http.Request) {
-		revoke(w,r,DB, &apiCfg)
+		revoke(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeChirpsWrite)).Delete("/chirps/{chirpID}",func(w http.ResponseWriter, r *http.Request) {
+		chirpsDelete(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareAuthRequired).Get("/trash",func(w http.ResponseWriter, r *http.Request) {
+		trashGet(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeChirpsWrite)).Post("/chirps/{chirpID}/restore",func(w http.ResponseWriter, r *http.Request) {
+		chirpsRestore(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareScope(scopeChirpsWrite)).Put("/chirps/{chirpID}",func(w http.ResponseWriter, r *http.Request) {
+		chirpsEdit(w,r,DB,&apiCfg)
+	})
+
+	apiRouter.With(apiCfg.middlewareAuthRequired).Get("/chirps/scheduled",func(w http.ResponseWriter, r *http.Request) {
+		scheduledChirpsGet(w,r,DB)
 	})
 
-	apiRouter.Delete("/chirps/{chirpID}",func(w http.ResponseWriter, r *http.Request) {
-		delete(w,r,DB, &apiCfg)
+	apiRouter.With(apiCfg.middlewareScope(scopeChirpsWrite)).Delete("/chirps/scheduled/{scheduledID}",func(w http.ResponseWriter, r *http.Request) {
+		scheduledChirpsDelete(w,r,DB)
+	})
+
+	apiRouter.With(apiCfg.middlewareAuthRequired).Get("/entitlements",func(w http.ResponseWriter, r *http.Request) {
+		entitlementsGet(w,r,DB,&apiCfg)
 	})
 
 	apiRouter.Post("/polka/webhooks",func(w http.ResponseWriter, r *http.Request,) {
@@ -91,14 +476,103 @@ func main() {
 	})
 
 
-	adminRouter.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+	oauthRouter.Get("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		oauthAuthorizeGet(w,r,DB)
+	})
+
+	oauthRouter.Post("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		oauthAuthorizePost(w,r,DB,&apiCfg)
+	})
+
+	oauthRouter.Post("/token", func(w http.ResponseWriter, r *http.Request) {
+		oauthToken(w,r,DB,&apiCfg)
+	})
+
+	oauthRouter.Post("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		oauthIntrospect(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permAdminMetrics)).Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		metricsHandler(w,r,&apiCfg)
 	})
 
+	adminRouter.With(apiCfg.middlewarePermission(permSettingsManage)).Get("/retention", func(w http.ResponseWriter, r *http.Request) {
+		adminRetentionGet(w,r,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permSettingsManage)).Put("/retention", func(w http.ResponseWriter, r *http.Request) {
+		adminRetentionPut(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Get("/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhooksGet(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Get("/webhooks/{eventID}", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhookGet(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Post("/webhooks/{eventID}/replay", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhookReplay(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Post("/webhook-endpoints", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhookEndpointsPost(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Get("/webhook-endpoints", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhookEndpointsGet(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Delete("/webhook-endpoints/{endpointID}", func(w http.ResponseWriter, r *http.Request) {
+		adminWebhookEndpointsDelete(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Get("/webhook-deliveries", func(w http.ResponseWriter, r *http.Request) {
+		adminDeliveriesGet(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permWebhooksManage)).Post("/webhook-deliveries/{deliveryID}/redeliver", func(w http.ResponseWriter, r *http.Request) {
+		adminDeliveryRedeliver(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permSettingsManage)).Get("/plans", func(w http.ResponseWriter, r *http.Request) {
+		adminPlansGet(w,r,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permSettingsManage)).Put("/plans", func(w http.ResponseWriter, r *http.Request) {
+		adminPlansPut(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Post("/users/{userID}/unlock", func(w http.ResponseWriter, r *http.Request) {
+		adminUnlockUser(w,r,DB,&apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Put("/users/{userID}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		adminRolesGrant(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Delete("/users/{userID}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		adminRolesRevoke(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Get("/users/{userID}/subscription", func(w http.ResponseWriter, r *http.Request) {
+		adminSubscriptionGet(w, r, DB, &apiCfg)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Put("/users/{userID}/require-2fa", func(w http.ResponseWriter, r *http.Request) {
+		adminRequire2FA(w,r,DB)
+	})
+
+	adminRouter.With(apiCfg.middlewarePermission(permUsersManage)).Delete("/users/{userID}/require-2fa", func(w http.ResponseWriter, r *http.Request) {
+		adminRequire2FA(w,r,DB)
+	})
+
 
 
 	r.Mount("/api", apiRouter)
 	r.Mount("/admin", adminRouter)
+	r.Mount("/oauth", oauthRouter)
 
 	log.Printf("Serving on port: %s\n", port)
 	log.Fatal(srv.ListenAndServe())
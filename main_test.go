@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse battery"
+
+// testClock is the apiConfig clock in tests, it only moves when a test moves it.
+type testClock struct {
+	mux *sync.Mutex
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mux.Lock()
+	defer clock.mux.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.mux.Lock()
+	defer clock.mux.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// testMailer keeps every email in memory instead of sending it.
+type testMailer struct {
+	mux  *sync.Mutex
+	sent []Message
+}
+
+func (m *testMailer) Send(msg Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Last returns the latest email sent to the address. Some emails are sent in the
+// background, so it waits a little for one to arrive.
+func (m *testMailer) Last(t *testing.T, to string) Message {
+	t.Helper()
+	for wait := 0; wait < 200; wait++ {
+		msg, found := m.last(to)
+		if found {
+			return msg
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no email was sent to %s", to)
+	return Message{}
+}
+
+func (m *testMailer) last(to string) (Message, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// testEnv is a database in a temporary directory and a config that uses it, with a
+// fake clock and an in-memory mailer. No background workers run.
+type testEnv struct {
+	db     *DB
+	cfg    *apiConfig
+	clock  *testClock
+	mailer *testMailer
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events = newChirpBus()
+	clock := &testClock{mux: &sync.Mutex{}, now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	mailer := &testMailer{mux: &sync.Mutex{}}
+
+	cfg := &apiConfig{
+		db:                db,
+		webhookWake:       make(chan struct{}, 1),
+		deliveryWake:      make(chan struct{}, 1),
+		webhookClient:     &http.Client{Timeout: deliveryTimeout},
+		subscriptionGrace: 3 * 24 * time.Hour,
+		defaultRetention:  Retention{ChirpDays: 7, UserDays: 30},
+		exports:           newExportStore(),
+		mailer:            mailer,
+		baseURL:           "http://chirpy.test",
+		accessTokenTTL:    time.Hour,
+		maxAccessTokenTTL: 24 * time.Hour,
+		refreshTokenTTL:   60 * 24 * time.Hour,
+		tokenLeeway:       30 * time.Second,
+		loginThrottle:     newLoginThrottle(),
+		passwordPolicy:    passwordPolicy{minLength: 8, maxLength: 1024, breached: map[string]bool{}},
+		apiRateLimiter:    newRateLimiter(0, time.Minute),
+		now:               clock.Now,
+	}
+	cfg.magicLinkIPLimiter = newRateLimiter(magicLinksPerIP, magicLinkWindow)
+	cfg.magicLinkEmailLimiter = newRateLimiter(magicLinksPerEmail, magicLinkWindow)
+	cfg.passwordResetIPLimiter = newRateLimiter(passwordResetsPerIP, passwordResetWindow)
+	cfg.passwordResetEmailLimiter = newRateLimiter(passwordResetsPerEmail, passwordResetWindow)
+	cfg.revocations, err = newRevocationList(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.plans, err = newPlanCatalog(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cheapest hashing there is, tests hash a lot of passwords
+	cfg.passwords, err = newPasswordHashing(bcryptHasher{cost: bcrypt.MinCost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.keys, err = newKeyring(t.TempDir(), "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{db: db, cfg: cfg, clock: clock, mailer: mailer}
+}
+
+// createUser adds a user with a verified email and testPassword.
+func (env *testEnv) createUser(t *testing.T, email string) User {
+	t.Helper()
+	hash, err := env.cfg.passwords.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := env.db.CreateUser(email, hash, "", "", env.cfg.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.db.SetEmailVerified(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.EmailVerified = true
+	return user
+}
+
+// accessToken starts a session for the user and issues a full access token for it.
+func (env *testEnv) accessToken(t *testing.T, user User) string {
+	t.Helper()
+	sessionId, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := env.cfg.now()
+	err = env.db.CreateSession(Session{Id: sessionId, UserId: user.Id, CreatedAt: now, LastUsedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := issueToken(env.cfg, user.Id, env.cfg.accessTokenTTL, tokenClaims{
+		TokenType: tokenTypeAccess,
+		SessionId: sessionId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// do sends a request to handler, body is marshalled to JSON unless it is nil.
+func do(t *testing.T, handler http.Handler, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody unmarshals a JSON response into v.
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.Unmarshal(rec.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// tokenFromEmail finds the one-time token in an email, on its own line or in a link.
+func tokenFromEmail(t *testing.T, msg Message) string {
+	t.Helper()
+	for _, field := range strings.Fields(msg.Body) {
+		_, token, found := strings.Cut(field, "token=")
+		if found {
+			return token
+		}
+		if len(field) == 64 && strings.Trim(field, "0123456789abcdef") == "" {
+			return field
+		}
+	}
+	t.Fatalf("no token in email %q", msg.Body)
+	return ""
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const authCodeTTL = 10 * time.Minute
+
+// consentData is what assets/consent.html is rendered with.
+type consentData struct {
+	ClientName          string
+	ClientId            string
+	RedirectURI         string
+	Scope               string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Error               string
+}
+
+// validateRedirectURI only allows absolute https URLs, or http for local development.
+func validateRedirectURI(rawURI string) error {
+	uri, err := url.Parse(rawURI)
+	if err != nil || uri.Host == "" || uri.Fragment != "" {
+		return errors.New("invalid redirect uri: " + rawURI)
+	}
+	if uri.Scheme == "https" {
+		return nil
+	}
+	if uri.Scheme == "http" && (uri.Hostname() == "localhost" || uri.Hostname() == "127.0.0.1") {
+		return nil
+	}
+	return errors.New("redirect uri must use https: " + rawURI)
+}
+
+func oauthClientsPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+
+	type requestBodyParams struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(bodyFetched.Name)
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(bodyFetched.RedirectURIs) == 0 {
+		http.Error(w, "at least one redirect uri is required", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range bodyFetched.RedirectURIs {
+		err = validateRedirectURI(uri)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	clientId, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	client := OAuthClient{
+		Id:           clientId[:32],
+		OwnerId:      principal.UserId,
+		Name:         name,
+		RedirectURIs: bodyFetched.RedirectURIs,
+		CreatedAt:    apiCfg.now(),
+	}
+	clientSecret := ""
+	if bodyFetched.Confidential {
+		clientSecret, err = randomToken()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		client.SecretHash = hashToken(clientSecret)
+	}
+	err = db.CreateOAuthClient(client)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+
+	// the secret is only shown here
+	respondWithJSON(w, http.StatusCreated, struct {
+		ClientId     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret,omitempty"`
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+	}{
+		ClientId:     client.Id,
+		ClientSecret: clientSecret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+	})
+}
+
+// parseAuthorizeRequest validates the parameters of an authorization request. If the
+// client or redirect uri are wrong the error must be shown to the user, otherwise
+// errorCode is set and the error is sent back to the client's redirect uri.
+func parseAuthorizeRequest(db *DB, values url.Values) (consentData, string, error) {
+	data := consentData{
+		ClientId:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+	client, err := db.GetOAuthClient(data.ClientId)
+	if err != nil {
+		return data, "", errors.New("unknown client")
+	}
+	data.ClientName = client.Name
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		if uri == data.RedirectURI {
+			registered = true
+		}
+	}
+	if !registered {
+		return data, "", errors.New("redirect uri is not registered for this client")
+	}
+
+	if values.Get("response_type") != "code" {
+		return data, "unsupported_response_type", errors.New("only the code response type is supported")
+	}
+	// PKCE is required for every client, and only with S256
+	if data.CodeChallenge == "" || data.CodeChallengeMethod != "S256" {
+		return data, "invalid_request", errors.New("a S256 code_challenge is required")
+	}
+	data.Scopes = strings.Fields(data.Scope)
+	if len(data.Scopes) == 0 {
+		return data, "invalid_scope", errors.New("scope is required")
+	}
+	for _, scope := range data.Scopes {
+		if !knownScopes[scope] {
+			return data, "invalid_scope", errors.New("unknown scope: " + scope)
+		}
+	}
+	return data, "", nil
+}
+
+// redirectWithParams sends the browser back to the client with the given query parameters.
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	query := uri.Query()
+	for key, values := range params {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	uri.RawQuery = query.Encode()
+	http.Redirect(w, r, uri.String(), http.StatusFound)
+}
+
+func renderConsent(w http.ResponseWriter, code int, data consentData) {
+	tmpl, err := template.ParseFiles("assets/consent.html")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the consent page must not be framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(code)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func oauthAuthorizeGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	data, errorCode, err := parseAuthorizeRequest(db, r.URL.Query())
+	if err != nil && errorCode == "" {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		redirectWithParams(w, r, data.RedirectURI, url.Values{"error": {errorCode}, "error_description": {err.Error()}, "state": {data.State}})
+		return
+	}
+	renderConsent(w, http.StatusOK, data)
+}
+
+func oauthAuthorizePost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	data, errorCode, err := parseAuthorizeRequest(db, r.PostForm)
+	if err != nil && errorCode == "" {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		redirectWithParams(w, r, data.RedirectURI, url.Values{"error": {errorCode}, "error_description": {err.Error()}, "state": {data.State}})
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		redirectWithParams(w, r, data.RedirectURI, url.Values{"error": {"access_denied"}, "state": {data.State}})
+		return
+	}
+
+	user, err := authenticateUser(db, apiCfg, clientIP(r), r.PostForm.Get("email"), r.PostForm.Get("password"))
+	var locked loginLockedError
+	if errors.As(err, &locked) {
+		data.Error = "Too many failed attempts, try again later."
+		renderConsent(w, http.StatusTooManyRequests, data)
+		return
+	}
+	if err != nil {
+		data.Error = "Wrong email or password."
+		renderConsent(w, http.StatusUnauthorized, data)
+		return
+	}
+
+	// the consent form is a login too, so it needs the second factor like /api/login/2fa
+	if twoFactorRequired(user) && !user.TOTPEnabled {
+		data.Error = "Set up two-factor authentication before authorizing apps."
+		renderConsent(w, http.StatusForbidden, data)
+		return
+	}
+	if user.TOTPEnabled {
+		err = checkSecondFactor(db, apiCfg, user, r.PostForm.Get("code"), r.PostForm.Get("recovery_code"))
+		if err != nil {
+			apiCfg.loginThrottle.Failure(user.Email, clientIP(r), apiCfg.now())
+			data.Error = "Enter a valid code from your authenticator app or a recovery code."
+			renderConsent(w, http.StatusUnauthorized, data)
+			return
+		}
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = db.SaveAuthCode(hashToken(code), AuthCode{
+		ClientId:      data.ClientId,
+		UserId:        user.Id,
+		RedirectURI:   data.RedirectURI,
+		Scope:         strings.Join(data.Scopes, " "),
+		CodeChallenge: data.CodeChallenge,
+		ExpiresAt:     apiCfg.now().Add(authCodeTTL),
+	})
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	redirectWithParams(w, r, data.RedirectURI, url.Values{"code": {code}, "state": {data.State}})
+}
+
+// oauthError writes an RFC 6749 error response.
+func oauthError(w http.ResponseWriter, code int, errorCode string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}{
+		Error:            errorCode,
+		ErrorDescription: description,
+	})
+}
+
+// authenticateClient finds the client of a token or introspection request. Confidential
+// clients must send their secret, with HTTP basic auth or as client_secret.
+func authenticateClient(db *DB, r *http.Request) (OAuthClient, error) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	client, err := db.GetOAuthClient(clientId)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	if client.SecretHash == "" {
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return OAuthClient{}, errors.New("invalid client secret")
+	}
+	return client, nil
+}
+
+// verifyCodeChallenge checks a PKCE code_verifier against the S256 challenge.
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func oauthToken(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	client, err := authenticateClient(db, r)
+	if err != nil {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	code, err := db.ConsumeAuthCode(hashToken(r.PostForm.Get("code")), apiCfg.now())
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code is invalid or expired")
+		return
+	}
+	if code.ClientId != client.Id || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client or redirect uri")
+		return
+	}
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	// the app gets a session of its own, so logging out everywhere, a password reset
+	// or deleting the account cut it off too
+	session, err := createSession(db, apiCfg, r, code.UserId, client.Id)
+	if err != nil {
+		log.Print("Error creating OAuth session: " + err.Error())
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	accessToken, err := issueToken(apiCfg, code.UserId, apiCfg.accessTokenTTL, tokenClaims{
+		TokenType: tokenTypeAccess,
+		Scope:     code.Scope,
+		SessionId: session.Id,
+		ClientId:  client.Id,
+	})
+	if err != nil {
+		log.Print("Error issuing OAuth token: " + err.Error())
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(apiCfg.accessTokenTTL.Seconds()),
+		Scope:       code.Scope,
+	})
+}
+
+// oauthIntrospect implements RFC 7662 for confidential clients.
+func oauthIntrospect(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	client, err := authenticateClient(db, r)
+	if err != nil || client.SecretHash == "" {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "introspection needs a confidential client")
+		return
+	}
+
+	type introspection struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientId  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		Issuer    string `json:"iss,omitempty"`
+	}
+	claims, userId, err := parseAccessToken(apiCfg, r.PostForm.Get("token"))
+	if err == nil {
+		// tokens of accounts waiting to be purged aren't active either
+		user, lookupErr := GetUserById(db, userId)
+		if lookupErr != nil || user.DeletedAt != nil {
+			err = errInvalidToken
+		}
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusOK, introspection{Active: false})
+		return
+	}
+	scope := claims.Scope
+	if scope == "" {
+		// tokens from a password login can do everything
+		scopes := []string{}
+		for known := range knownScopes {
+			scopes = append(scopes, known)
+		}
+		sort.Strings(scopes)
+		scope = strings.Join(scopes, " ")
+	}
+	respondWithJSON(w, http.StatusOK, introspection{
+		Active:    true,
+		Scope:     scope,
+		ClientId:  claims.ClientId,
+		Subject:   claims.Subject,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		Issuer:    claims.Issuer,
+	})
+}
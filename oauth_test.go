@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+// postConsent submits the consent form approving a request for profile:write.
+func postConsent(t *testing.T, env *testEnv, fields url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	sum := sha256.Sum256([]byte("a code verifier that is long enough to be accepted"))
+	form := url.Values{
+		"client_id":             {"test-client"},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {scopeProfileWrite},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"decision":              {"approve"},
+	}
+	for key, values := range fields {
+		form[key] = values
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	oauthAuthorizePost(rec, req, env.db, env.cfg)
+	return rec
+}
+
+// redirectedCode returns the authorization code the consent form redirected with, if any.
+func redirectedCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if rec.Code != http.StatusFound {
+		return ""
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code")
+}
+
+func TestAuthorizeRequiresSecondFactor(t *testing.T) {
+	tests := []struct {
+		name     string
+		totp     bool
+		require  bool
+		fields   func(secret string, recoveryCodes []string) url.Values
+		status   int
+		wantCode bool
+	}{
+		{
+			name:     "password only without two-factor",
+			fields:   func(string, []string) url.Values { return url.Values{} },
+			status:   http.StatusFound,
+			wantCode: true,
+		},
+		{
+			name:   "password only with TOTP",
+			totp:   true,
+			fields: func(string, []string) url.Values { return url.Values{} },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "wrong TOTP code",
+			totp:   true,
+			fields: func(string, []string) url.Values { return url.Values{"code": {"000000"}} },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "TOTP code",
+			totp:     true,
+			fields:   nil,
+			status:   http.StatusFound,
+			wantCode: true,
+		},
+		{
+			name: "recovery code",
+			totp: true,
+			fields: func(secret string, recoveryCodes []string) url.Values {
+				return url.Values{"recovery_code": {recoveryCodes[0]}}
+			},
+			status:   http.StatusFound,
+			wantCode: true,
+		},
+		{
+			name:    "two-factor required but not enrolled",
+			require: true,
+			fields:  func(string, []string) url.Values { return url.Values{} },
+			status:  http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			user := env.createUser(t, "user@example.com")
+			err := env.db.CreateOAuthClient(OAuthClient{
+				Id:           "test-client",
+				OwnerId:      user.Id,
+				Name:         "Test app",
+				RedirectURIs: []string{testRedirectURI},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.require {
+				err = env.db.SetRequire2FA(user.Id, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			secret, recoveryCodes := "", []string{}
+			if tt.totp {
+				secret, recoveryCodes = enrollTOTP(t, env, user)
+			}
+
+			fields := url.Values{}
+			if tt.fields == nil {
+				fields.Set("code", currentTOTP(t, env, secret))
+			} else {
+				fields = tt.fields(secret, recoveryCodes)
+			}
+			fields.Set("email", "user@example.com")
+			fields.Set("password", testPassword)
+
+			rec := postConsent(t, env, fields)
+			if rec.Code != tt.status {
+				t.Errorf("got %d, want %d", rec.Code, tt.status)
+			}
+			if code := redirectedCode(t, rec); (code != "") != tt.wantCode {
+				t.Errorf("got code %q, want a code %v", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// postForm sends a form to handler, the way apps call the token and introspection endpoints.
+func postForm(t *testing.T, handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/oauth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestOAuthTokensEndWithTheUsersSessions(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(t *testing.T, env *testEnv, user User)
+		// rejected is whether API requests fail too, not only introspection
+		rejected bool
+	}{
+		{
+			name:     "logout everywhere",
+			rejected: true,
+			end: func(t *testing.T, env *testEnv, user User) {
+				err := env.db.RevokeAllSessions(user.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// the delete handler also ends every session, this checks introspection alone
+			name: "account deleted",
+			end: func(t *testing.T, env *testEnv, user User) {
+				_, err := env.db.SoftDeleteUser(user.Id, env.cfg.now())
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			user := env.createUser(t, "user@example.com")
+			for _, client := range []OAuthClient{
+				{Id: "test-client", OwnerId: user.Id, Name: "Test app", RedirectURIs: []string{testRedirectURI}},
+				{Id: "backend", OwnerId: user.Id, Name: "Resource server", SecretHash: hashToken("backend secret")},
+			} {
+				err := env.db.CreateOAuthClient(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			code := redirectedCode(t, postConsent(t, env, url.Values{
+				"email":    {"user@example.com"},
+				"password": {testPassword},
+			}))
+			rec := postForm(t, func(w http.ResponseWriter, r *http.Request) {
+				oauthToken(w, r, env.db, env.cfg)
+			}, url.Values{
+				"grant_type":    {"authorization_code"},
+				"client_id":     {"test-client"},
+				"code":          {code},
+				"redirect_uri":  {testRedirectURI},
+				"code_verifier": {"a code verifier that is long enough to be accepted"},
+			})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("token: got %d %s", rec.Code, rec.Body)
+			}
+			response := struct {
+				AccessToken string `json:"access_token"`
+			}{}
+			decodeBody(t, rec, &response)
+
+			active := func() bool {
+				t.Helper()
+				rec := postForm(t, func(w http.ResponseWriter, r *http.Request) {
+					oauthIntrospect(w, r, env.db, env.cfg)
+				}, url.Values{
+					"client_id":     {"backend"},
+					"client_secret": {"backend secret"},
+					"token":         {response.AccessToken},
+				})
+				introspection := struct {
+					Active bool `json:"active"`
+				}{}
+				decodeBody(t, rec, &introspection)
+				return introspection.Active
+			}
+			usable := func() bool {
+				t.Helper()
+				rec := do(t, env.cfg.middlewareAuthRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNoContent)
+				})), http.MethodGet, "/api/users/me", response.AccessToken, nil)
+				return rec.Code == http.StatusNoContent
+			}
+
+			if !active() || !usable() {
+				t.Fatal("a fresh app token should be active and usable")
+			}
+			tt.end(t, env, user)
+			if active() {
+				t.Error("introspection still reports the app token active")
+			}
+			if tt.rejected && usable() {
+				t.Error("the app token still works after logging out everywhere")
+			}
+		})
+	}
+}
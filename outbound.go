@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	eventChirpCreated = "chirp.created"
+	eventChirpDeleted = "chirp.deleted"
+	eventUserCreated  = "user.created"
+	eventUserUpgraded = "user.upgraded"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	// deliveryFailed deliveries gave up after deliveryMaxAttempts, they can be redelivered
+	deliveryFailed = "failed"
+
+	deliveryMaxAttempts = 10
+	deliveryTimeout     = 10 * time.Second
+	// delivered deliveries are kept in the log this long
+	deliveryMemory = 30 * 24 * time.Hour
+
+	chirpyEventHeader     = "X-Chirpy-Event"
+	chirpyDeliveryHeader  = "X-Chirpy-Delivery"
+	chirpyTimestampHeader = "X-Chirpy-Timestamp"
+	chirpySignatureHeader = "X-Chirpy-Signature"
+)
+
+var knownEvents = map[string]bool{
+	eventChirpCreated: true,
+	eventChirpDeleted: true,
+	eventUserCreated:  true,
+	eventUserUpgraded: true,
+}
+
+// WebhookEndpoint is a downstream URL that gets the events it subscribed to. Deliveries
+// are signed with Secret the same way Polka signs what it sends us.
+type WebhookEndpoint struct {
+	Id        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (endpoint WebhookEndpoint) Subscribed(event string) bool {
+	for _, val := range endpoint.Events {
+		if val == event {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryAttempt is one try at sending a delivery, for the delivery log.
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// WebhookDelivery is one event on its way to one endpoint.
+type WebhookDelivery struct {
+	Id            string            `json:"id"`
+	EndpointId    string            `json:"endpoint_id"`
+	EventId       string            `json:"event_id"`
+	Event         string            `json:"event"`
+	Payload       json.RawMessage   `json:"payload"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	DeliveredAt   *time.Time        `json:"delivered_at,omitempty"`
+	Log           []DeliveryAttempt `json:"log"`
+}
+
+// emitEvent queues event for every endpoint subscribed to it. Failing to queue is
+// logged but never fails the request that caused the event.
+func (cfg *apiConfig) emitEvent(event string, data interface{}) {
+	eventId, err := randomToken()
+	if err != nil {
+		log.Print("Error emitting " + event + ": " + err.Error())
+		return
+	}
+	now := cfg.now()
+	payload, err := json.Marshal(struct {
+		Id        string      `json:"id"`
+		Event     string      `json:"event"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{
+		Id:        eventId,
+		Event:     event,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		log.Print("Error emitting " + event + ": " + err.Error())
+		return
+	}
+	queued, err := cfg.db.QueueDeliveries(eventId, event, payload, now, deliveryMemory)
+	if err != nil {
+		log.Print("Error emitting " + event + ": " + err.Error())
+		return
+	}
+	if queued > 0 {
+		cfg.wakeDeliveryWorker()
+	}
+}
+
+// wakeDeliveryWorker asks the delivery worker to send queued deliveries now, it never blocks.
+func (cfg *apiConfig) wakeDeliveryWorker() {
+	select {
+	case cfg.deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// sendDelivery makes one attempt at a delivery, any 2xx response counts as delivered.
+func sendDelivery(client *http.Client, endpoint WebhookEndpoint, delivery WebhookDelivery, now time.Time) DeliveryAttempt {
+	attempt := DeliveryAttempt{At: now}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	// the database file is indented, so the stored payload is too
+	body := &bytes.Buffer{}
+	err := json.Compact(body, delivery.Payload)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(chirpyEventHeader, delivery.Event)
+	req.Header.Set(chirpyDeliveryHeader, delivery.Id)
+	req.Header.Set(chirpyTimestampHeader, timestamp)
+	req.Header.Set(chirpySignatureHeader, "sha256="+hex.EncodeToString(signWebhook(endpoint.Secret, timestamp, body.Bytes())))
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "unexpected status " + resp.Status
+	}
+	return attempt
+}
+
+// processDelivery sends a delivery once and records the attempt.
+func processDelivery(db *DB, apiCfg *apiConfig, endpoint WebhookEndpoint, delivery WebhookDelivery) {
+	attempt := sendDelivery(apiCfg.webhookClient, endpoint, delivery, apiCfg.now())
+	_, err := db.UpdateDelivery(delivery.Id, func(stored *WebhookDelivery) error {
+		stored.Attempts++
+		stored.Log = append(stored.Log, attempt)
+		if attempt.Error == "" {
+			stored.Status = deliveryDelivered
+			stored.DeliveredAt = &attempt.At
+			return nil
+		}
+		if stored.Attempts >= deliveryMaxAttempts {
+			stored.Status = deliveryFailed
+			return nil
+		}
+		stored.NextAttemptAt = attempt.At.Add(webhookRetryDelay(stored.Attempts))
+		return nil
+	})
+	if err != nil {
+		log.Print("Error saving webhook delivery: " + err.Error())
+		return
+	}
+	if attempt.Error != "" {
+		log.Printf("Webhook delivery %s to %s failed: %s", delivery.Id, endpoint.URL, attempt.Error)
+	}
+}
+
+// webhookSender sends due deliveries with a goroutine per endpoint, so a slow or
+// unreachable endpoint only holds up its own deliveries. An endpoint gets a new
+// goroutine once the previous one is done.
+type webhookSender struct {
+	mux  *sync.Mutex
+	busy map[string]bool
+	wg   *sync.WaitGroup
+}
+
+func newWebhookSender() *webhookSender {
+	return &webhookSender{
+		mux:  &sync.Mutex{},
+		busy: map[string]bool{},
+		wg:   &sync.WaitGroup{},
+	}
+}
+
+// sendDue starts sending the due deliveries of every endpoint that isn't busy,
+// each endpoint's oldest first. It doesn't wait for them.
+func (sender *webhookSender) sendDue(db *DB, apiCfg *apiConfig) error {
+	deliveries, err := db.GetDeliveries("", deliveryPending)
+	if err != nil {
+		return err
+	}
+	endpoints, err := db.GetWebhookEndpoints()
+	if err != nil {
+		return err
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+	})
+	now := apiCfg.now()
+	due := map[string][]WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if !delivery.NextAttemptAt.After(now) {
+			due[delivery.EndpointId] = append(due[delivery.EndpointId], delivery)
+		}
+	}
+
+	sender.mux.Lock()
+	defer sender.mux.Unlock()
+	for _, endpoint := range endpoints {
+		if len(due[endpoint.Id]) == 0 || sender.busy[endpoint.Id] {
+			continue
+		}
+		sender.busy[endpoint.Id] = true
+		sender.wg.Add(1)
+		go func(endpoint WebhookEndpoint, deliveries []WebhookDelivery) {
+			defer sender.wg.Done()
+			for _, delivery := range deliveries {
+				processDelivery(db, apiCfg, endpoint, delivery)
+			}
+			sender.mux.Lock()
+			delete(sender.busy, endpoint.Id)
+			sender.mux.Unlock()
+		}(endpoint, due[endpoint.Id])
+	}
+	return nil
+}
+
+// deliverWebhooks is the worker that sends due deliveries. It wakes up every interval,
+// or sooner when an event was emitted.
+func deliverWebhooks(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	sender := newWebhookSender()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-apiCfg.deliveryWake:
+		}
+		err := sender.sendDue(db, apiCfg)
+		if err != nil {
+			log.Print("Error loading webhook deliveries: " + err.Error())
+		}
+	}
+}
+
+func validateWebhookEndpoint(endpointURL string, events []string) error {
+	parsed, err := url.Parse(endpointURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(events) == 0 {
+		return errors.New("subscribe to at least one event")
+	}
+	for _, event := range events {
+		if !knownEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// adminWebhookEndpointsPost registers an endpoint. The response is the only time the
+// signing secret is shown.
+func adminWebhookEndpointsPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	err = validateWebhookEndpoint(bodyFetched.URL, bodyFetched.Events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	endpoint, err := db.CreateWebhookEndpoint(WebhookEndpoint{
+		Id:        id[:16],
+		URL:       bodyFetched.URL,
+		Events:    bodyFetched.Events,
+		Secret:    secret,
+		CreatedAt: apiCfg.now(),
+	})
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, endpoint)
+}
+
+// adminWebhookEndpointsGet lists the endpoints without their secrets.
+func adminWebhookEndpointsGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	endpoints, err := db.GetWebhookEndpoints()
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+	})
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	respondWithJSON(w, http.StatusOK, endpoints)
+}
+
+// adminWebhookEndpointsDelete removes an endpoint along with its deliveries.
+func adminWebhookEndpointsDelete(w http.ResponseWriter, r *http.Request, db *DB) {
+	err := db.DeleteWebhookEndpoint(chi.URLParam(r, "endpointID"))
+	if errors.Is(err, errWebhookEndpointNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminDeliveriesGet is the delivery log, newest first, filtered by ?endpoint_id= and ?status=.
+func adminDeliveriesGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != deliveryPending && status != deliveryDelivered && status != deliveryFailed {
+		http.Error(w, "status must be pending, delivered or failed", http.StatusBadRequest)
+		return
+	}
+	deliveries, err := db.GetDeliveries(r.URL.Query().Get("endpoint_id"), status)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// adminDeliveryRedeliver sends a delivery again with a fresh set of retries, whatever
+// happened to it before. The log keeps the earlier attempts.
+func adminDeliveryRedeliver(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	errAlreadyPending := errors.New("delivery is already waiting to be sent")
+	delivery, err := db.UpdateDelivery(chi.URLParam(r, "deliveryID"), func(stored *WebhookDelivery) error {
+		if stored.Status == deliveryPending {
+			return errAlreadyPending
+		}
+		stored.Status = deliveryPending
+		stored.Attempts = 0
+		stored.NextAttemptAt = apiCfg.now()
+		stored.DeliveredAt = nil
+		return nil
+	})
+	if errors.Is(err, errDeliveryNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errAlreadyPending) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	apiCfg.wakeDeliveryWorker()
+	respondWithJSON(w, http.StatusAccepted, delivery)
+}
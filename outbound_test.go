@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addEndpoint registers an endpoint for chirp.created deliveries to url.
+func addEndpoint(t *testing.T, env *testEnv, id string, url string) WebhookEndpoint {
+	t.Helper()
+	endpoint, err := env.db.CreateWebhookEndpoint(WebhookEndpoint{
+		Id:        id,
+		URL:       url,
+		Events:    []string{eventChirpCreated},
+		Secret:    "secret-" + id,
+		CreatedAt: env.cfg.now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return endpoint
+}
+
+// onlyDelivery returns the one delivery to the endpoint.
+func onlyDelivery(t *testing.T, env *testEnv, endpointId string) WebhookDelivery {
+	t.Helper()
+	deliveries, err := env.db.GetDeliveries(endpointId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestDeliveryIsSignedAndRetried(t *testing.T) {
+	env := newTestEnv(t)
+	mux := &sync.Mutex{}
+	calls := 0
+	var endpoint WebhookEndpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		want := "sha256=" + hex.EncodeToString(signWebhook(endpoint.Secret, r.Header.Get(chirpyTimestampHeader), body))
+		if !hmac.Equal([]byte(r.Header.Get(chirpySignatureHeader)), []byte(want)) {
+			t.Errorf("got signature %q, want %q", r.Header.Get(chirpySignatureHeader), want)
+		}
+		if r.Header.Get(chirpyEventHeader) != eventChirpCreated {
+			t.Errorf("got event header %q", r.Header.Get(chirpyEventHeader))
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		// the first attempt fails, the retry succeeds
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	endpoint = addEndpoint(t, env, "receiver", server.URL)
+
+	env.cfg.emitEvent(eventChirpCreated, map[string]int{"id": 1})
+	sender := newWebhookSender()
+	send := func() {
+		err := sender.sendDue(env.db, env.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.wg.Wait()
+	}
+
+	send()
+	delivery := onlyDelivery(t, env, endpoint.Id)
+	if delivery.Status != deliveryPending || delivery.Attempts != 1 || len(delivery.Log) != 1 {
+		t.Fatalf("after the failed attempt: got %+v", delivery)
+	}
+	if delivery.Log[0].StatusCode != http.StatusServiceUnavailable || delivery.Log[0].Error == "" {
+		t.Errorf("got log entry %+v, want the 503", delivery.Log[0])
+	}
+	if !delivery.NextAttemptAt.Equal(env.cfg.now().Add(webhookRetryBase)) {
+		t.Errorf("got next attempt at %v, want %v", delivery.NextAttemptAt, env.cfg.now().Add(webhookRetryBase))
+	}
+
+	// nothing is sent before the retry is due
+	send()
+	if delivery := onlyDelivery(t, env, endpoint.Id); delivery.Attempts != 1 {
+		t.Fatalf("retried early: got %d attempts", delivery.Attempts)
+	}
+
+	env.clock.Advance(webhookRetryBase)
+	send()
+	delivery = onlyDelivery(t, env, endpoint.Id)
+	if delivery.Status != deliveryDelivered || delivery.Attempts != 2 || delivery.DeliveredAt == nil {
+		t.Fatalf("after the retry: got %+v", delivery)
+	}
+	if len(delivery.Log) != 2 || delivery.Log[1].StatusCode != http.StatusNoContent || delivery.Log[1].Error != "" {
+		t.Errorf("got log %+v, want the 204 last", delivery.Log)
+	}
+}
+
+func TestSlowEndpointDoesNotHoldUpOthers(t *testing.T) {
+	env := newTestEnv(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fastCalled := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastCalled <- struct{}{}
+	}))
+	defer fast.Close()
+	addEndpoint(t, env, "slow", slow.URL)
+	addEndpoint(t, env, "fast", fast.URL)
+
+	env.cfg.emitEvent(eventChirpCreated, map[string]int{"id": 1})
+	sender := newWebhookSender()
+	err := sender.sendDue(env.db, env.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fastCalled:
+	case <-time.After(5 * time.Second):
+		t.Error("the fast endpoint waited for the slow one")
+	}
+	close(release)
+	sender.wg.Wait()
+
+	for _, id := range []string{"slow", "fast"} {
+		if delivery := onlyDelivery(t, env, id); delivery.Status != deliveryDelivered {
+			t.Errorf("%s: got status %q, want delivered", id, delivery.Status)
+		}
+	}
+}
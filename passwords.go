@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errPasswordMismatch = errors.New("password does not match")
+	errPasswordTooLong  = errors.New("password is too long")
+	errUnknownHash      = errors.New("unknown password hash format")
+)
+
+// PasswordHasher is one password hashing scheme.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Recognizes reports whether hash was made by this scheme, with any parameters.
+	Recognizes(hash string) bool
+	// Compare returns errPasswordMismatch if password doesn't produce hash.
+	Compare(hash string, password string) error
+	// Outdated reports whether hash was made with weaker parameters than the hasher's.
+	Outdated(hash string) bool
+}
+
+// bcryptHasher only looks at the first 72 bytes of a password, so longer ones are refused.
+type bcryptHasher struct {
+	cost int
+}
+
+func (hasher bcryptHasher) Hash(password string) (string, error) {
+	if len(password) > 72 {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.cost)
+	return string(hash), err
+}
+
+func (hasher bcryptHasher) Recognizes(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+func (hasher bcryptHasher) Compare(hash string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return errPasswordMismatch
+	}
+	return err
+}
+
+func (hasher bcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < hasher.cost
+}
+
+// argon2idHasher writes hashes in the PHC string format,
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>.
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (hasher argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, hasher.time, hasher.memory, hasher.threads, hasher.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, hasher.memory, hasher.time, hasher.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func parseArgon2id(hash string) (argon2idParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return argon2idParams{}, errUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2idParams{}, errUnknownHash
+	}
+	params := argon2idParams{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return argon2idParams{}, errUnknownHash
+	}
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2idParams{}, errUnknownHash
+	}
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return argon2idParams{}, errUnknownHash
+	}
+	return params, nil
+}
+
+func (hasher argon2idHasher) Recognizes(hash string) bool {
+	_, err := parseArgon2id(hash)
+	return err == nil
+}
+
+func (hasher argon2idHasher) Compare(hash string, password string) error {
+	params, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+	if subtle.ConstantTimeCompare(key, params.key) != 1 {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+func (hasher argon2idHasher) Outdated(hash string) bool {
+	params, err := parseArgon2id(hash)
+	return err != nil ||
+		params.memory < hasher.memory ||
+		params.time < hasher.time ||
+		params.threads < hasher.threads ||
+		uint32(len(params.key)) < hasher.keyLen
+}
+
+// passwordHashing hashes new passwords with the configured scheme and still
+// checks hashes made by the other schemes.
+type passwordHashing struct {
+	current PasswordHasher
+	known   []PasswordHasher
+	// dummyHash is compared against when a login names no account
+	dummyHash string
+}
+
+func newPasswordHashing(current PasswordHasher, known ...PasswordHasher) (*passwordHashing, error) {
+	hashing := &passwordHashing{
+		current: current,
+		known:   append([]PasswordHasher{current}, known...),
+	}
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	hashing.dummyHash, err = current.Hash(hex.EncodeToString(randomBytes))
+	if err != nil {
+		return nil, err
+	}
+	return hashing, nil
+}
+
+func (hashing *passwordHashing) Hash(password string) (string, error) {
+	return hashing.current.Hash(password)
+}
+
+func (hashing *passwordHashing) Compare(hash string, password string) error {
+	for _, hasher := range hashing.known {
+		if hasher.Recognizes(hash) {
+			return hasher.Compare(hash, password)
+		}
+	}
+	return errUnknownHash
+}
+
+// NeedsRehash reports whether hash should be replaced by one from the current scheme.
+func (hashing *passwordHashing) NeedsRehash(hash string) bool {
+	return !hashing.current.Recognizes(hash) || hashing.current.Outdated(hash)
+}
+
+// passwordHashingFromEnv builds the hashing config from PASSWORD_HASHER ("argon2id" or
+// "bcrypt"), BCRYPT_COST and ARGON2_MEMORY_KIB, ARGON2_TIME, ARGON2_THREADS.
+func passwordHashingFromEnv() (*passwordHashing, error) {
+	bcryptScheme := bcryptHasher{cost: intFromEnv("BCRYPT_COST", bcrypt.DefaultCost)}
+	argon2idScheme := argon2idHasher{
+		memory:  uint32(intFromEnv("ARGON2_MEMORY_KIB", 64*1024)),
+		time:    uint32(intFromEnv("ARGON2_TIME", 1)),
+		threads: uint8(intFromEnv("ARGON2_THREADS", 4)),
+		keyLen:  32,
+		saltLen: 16,
+	}
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "", "argon2id":
+		return newPasswordHashing(argon2idScheme, bcryptScheme)
+	case "bcrypt":
+		return newPasswordHashing(bcryptScheme, argon2idScheme)
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_HASHER %q", os.Getenv("PASSWORD_HASHER"))
+	}
+}
+
+// passwordPolicy decides which new passwords are accepted.
+type passwordPolicy struct {
+	minLength int
+	maxLength int
+	// breached holds the upper case SHA-1 hex of known breached passwords
+	breached map[string]bool
+}
+
+// loadBreachedPasswords reads a breached password list. A line is either a password
+// or the SHA-1 of one in the "HASH:COUNT" format of the Pwned Passwords downloads.
+// A missing file is only an error when it is required, otherwise the list is empty.
+func loadBreachedPasswords(path string, required bool) (map[string]bool, error) {
+	breached := map[string]bool{}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return breached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, _, hasCount := strings.Cut(line, ":")
+		if len(hash) == 40 && hasCount {
+			breached[strings.ToUpper(hash)] = true
+			continue
+		}
+		breached[sha1Hex(line)] = true
+	}
+	return breached, scanner.Err()
+}
+
+func sha1Hex(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Validate returns an error the user can read if password is not allowed.
+func (policy passwordPolicy) Validate(password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+	if utf8.RuneCountInString(password) < policy.minLength {
+		return fmt.Errorf("password must be at least %d characters", policy.minLength)
+	}
+	if len(password) > policy.maxLength {
+		return errPasswordTooLong
+	}
+	if policy.breached[sha1Hex(password)] {
+		return errors.New("this password has appeared in a data breach, choose another one")
+	}
+	return nil
+}
+
+// hashNewPassword checks a new password against the policy and hashes it,
+// the returned error is meant for the user.
+func (cfg *apiConfig) hashNewPassword(password string) (string, error) {
+	err := cfg.passwordPolicy.Validate(password)
+	if err != nil {
+		return "", err
+	}
+	return cfg.passwords.Hash(password)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "breached.txt")
+	err := os.WriteFile(listPath, []byte("# comment\npassword123\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		required bool
+		wantErr  bool
+		wantSize int
+	}{
+		{name: "list", path: listPath, required: true, wantSize: 2},
+		{name: "missing default", path: filepath.Join(dir, "missing.txt"), required: false, wantSize: 0},
+		{name: "missing configured", path: filepath.Join(dir, "missing.txt"), required: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breached, err := loadBreachedPasswords(tt.path, tt.required)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(breached) != tt.wantSize {
+				t.Errorf("got %d hashes, want %d", len(breached), tt.wantSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// handles are 3-15 characters of letters, digits and underscores
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,15}$`)
+
+// handles that would clash with routes or impersonate the service
+var reservedHandles = map[string]bool{
+	"admin":     true,
+	"api":       true,
+	"chirpy":    true,
+	"help":      true,
+	"me":        true,
+	"moderator": true,
+	"root":      true,
+	"support":   true,
+	"system":    true,
+}
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+)
+
+// Profile is the public view of a user, it never contains the email or password hash.
+type Profile struct {
+	Id             int       `json:"id"`
+	Handle         string    `json:"handle"`
+	DisplayName    string    `json:"display_name"`
+	Bio            string    `json:"bio"`
+	AvatarMediaId  string    `json:"avatar_media_id"`
+	JoinedAt       time.Time `json:"joined_at"`
+	ChirpCount     int       `json:"chirp_count"`
+	FollowerCount  int       `json:"follower_count"`
+	FollowingCount int       `json:"following_count"`
+}
+
+func validateHandle(handle string) error {
+	if !handlePattern.MatchString(handle) {
+		return errors.New("handle must be 3-15 letters, digits or underscores")
+	}
+	if reservedHandles[strings.ToLower(handle)] {
+		return errors.New("handle is reserved")
+	}
+	return nil
+}
+
+func validateProfile(displayName string, bio string) error {
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return errors.New("display name is too long")
+	}
+	if utf8.RuneCountInString(bio) > maxBioLength {
+		return errors.New("bio is too long")
+	}
+	return nil
+}
+
+func buildProfile(db *DB, user User) (Profile, error) {
+	chirps, followers, following, err := db.ProfileCounts(user.Id)
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{
+		Id:             user.Id,
+		Handle:         user.Handle,
+		DisplayName:    user.DisplayName,
+		Bio:            user.Bio,
+		AvatarMediaId:  user.AvatarMediaId,
+		JoinedAt:       user.CreatedAt,
+		ChirpCount:     chirps,
+		FollowerCount:  followers,
+		FollowingCount: following,
+	}, nil
+}
+
+func profileGetById(w http.ResponseWriter, r *http.Request, db *DB) {
+	numericId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	user, err := GetUserById(db, numericId)
+	if err != nil || user.DeletedAt != nil {
+		http.NotFound(w, r)
+		return
+	}
+	profile, err := buildProfile(db, user)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func profileGetByHandle(w http.ResponseWriter, r *http.Request, db *DB) {
+	user, err := GetUserByHandle(db, chi.URLParam(r, "handle"))
+	if err != nil || user.DeletedAt != nil {
+		http.NotFound(w, r)
+		return
+	}
+	profile, err := buildProfile(db, user)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func profilePut(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	userId := principal.UserId
+	if !requireVerified(w, db, userId) {
+		return
+	}
+
+	// every field is optional, only the ones that are sent get changed
+	type requestBodyParams struct {
+		Handle        *string `json:"handle"`
+		DisplayName   *string `json:"display_name"`
+		Bio           *string `json:"bio"`
+		AvatarMediaId *string `json:"avatar_media_id"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	// an empty handle removes it, any other handle must be valid
+	if bodyFetched.Handle != nil && *bodyFetched.Handle != "" {
+		err = validateHandle(*bodyFetched.Handle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	displayName, bio := "", ""
+	if bodyFetched.DisplayName != nil {
+		displayName = *bodyFetched.DisplayName
+	}
+	if bodyFetched.Bio != nil {
+		bio = *bodyFetched.Bio
+	}
+	err = validateProfile(displayName, bio)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.UpdateProfile(userId, bodyFetched.Handle, bodyFetched.DisplayName, bodyFetched.Bio, bodyFetched.AvatarMediaId)
+	if err != nil {
+		if errors.Is(err, errHandleTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	profile, err := buildProfile(db, user)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+// followTarget returns the user in the URL, who must exist and can't be the caller.
+func followTarget(w http.ResponseWriter, r *http.Request, db *DB) (Principal, User, bool) {
+	principal, _ := principalFromContext(r.Context())
+	numericId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return principal, User{}, false
+	}
+	if numericId == principal.UserId {
+		http.Error(w, "you can't follow yourself", http.StatusBadRequest)
+		return principal, User{}, false
+	}
+	user, err := GetUserById(db, numericId)
+	if err != nil || user.DeletedAt != nil {
+		http.NotFound(w, r)
+		return principal, User{}, false
+	}
+	return principal, user, true
+}
+
+// followPost makes the caller follow a user, following someone twice is a no-op.
+func followPost(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, user, ok := followTarget(w, r, db)
+	if !ok {
+		return
+	}
+	err := db.Follow(principal.UserId, user.Id)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// followDelete makes the caller stop following a user.
+func followDelete(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, user, ok := followTarget(w, r, db)
+	if !ok {
+		return
+	}
+	err := db.Unfollow(principal.UserId, user.Id)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
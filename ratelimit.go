@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit events per key in any sliding window of length window.
+type rateLimiter struct {
+	mux    *sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		mux:    &sync.Mutex{},
+		limit:  limit,
+		window: window,
+		events: map[string][]time.Time{},
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// When it isn't, it also returns how long until the next event would be allowed.
+func (limiter *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	return limiter.AllowLimit(key, limiter.limit, now)
+}
+
+// AllowLimit is Allow with a limit for this key only, for limits that differ between callers.
+func (limiter *rateLimiter) AllowLimit(key string, limit int, now time.Time) (bool, time.Duration) {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+
+	recent := limiter.recent(key, now)
+	if len(recent) >= limit {
+		limiter.events[key] = recent
+		return false, recent[0].Add(limiter.window).Sub(now)
+	}
+	limiter.events[key] = append(recent, now)
+	return true, 0
+}
+
+func (limiter *rateLimiter) recent(key string, now time.Time) []time.Time {
+	recent := []time.Time{}
+	for _, val := range limiter.events[key] {
+		if now.Sub(val) < limiter.window {
+			recent = append(recent, val)
+		}
+	}
+	return recent
+}
+
+func (limiter *rateLimiter) prune(now time.Time) {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+
+	events := map[string][]time.Time{}
+	for key := range limiter.events {
+		recent := limiter.recent(key, now)
+		if len(recent) > 0 {
+			events[key] = recent
+		}
+	}
+	limiter.events = events
+}
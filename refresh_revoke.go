@@ -2,56 +2,79 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt"
 )
 
-func refresh(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
-	// Validate and parse the JWT token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return apiCfg.jwtSecret, nil
+// issueRefreshToken starts the token family of a session and returns the opaque token.
+func issueRefreshToken(db *DB, apiCfg *apiConfig, userId int, familyId string) (string, error) {
+	rawToken, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := apiCfg.now()
+	err = db.SaveRefreshToken(hashToken(rawToken), RefreshToken{
+		UserId:    userId,
+		FamilyId:  familyId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(apiCfg.refreshTokenTTL),
 	})
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		return "", err
 	}
+	return rawToken, nil
+}
 
-	claims, ok := token.Claims.(*jwt.StandardClaims)
+func refresh(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
 
-	if !ok || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	newRefreshToken, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rotated, err := db.RotateRefreshToken(hashToken(tokenString), hashToken(newRefreshToken), apiCfg.now(), apiCfg.refreshTokenTTL)
+	if errors.Is(err, errTokenReused) {
+		// someone else holds a copy of this token, the whole family has been revoked
+		log.Print("refresh token reuse detected, token family revoked")
+		unauthorized(w, err)
 		return
 	}
-	if claims.Issuer == "chirpy-access" {
-		http.Error(w, "no access", http.StatusUnauthorized)
+	if err != nil {
+		unauthorized(w, err)
 		return
 	}
+	userId := rotated.UserId
 
-	if GetRevoke(db, tokenString) {
+	// tokens of purged accounts, or accounts waiting to be purged, can not be refreshed
+	user, err := GetUserById(db, userId)
+	if err != nil || user.DeletedAt != nil {
 		http.Error(w, "this token is revoked !", http.StatusUnauthorized)
 		return
 	}
 
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Subject:   claims.Subject,
-		ExpiresAt: time.Now().UTC().Unix() + int64(time.Hour),
-		Issuer:   "chirpy-access",
-		IssuedAt: time.Now().UTC().Unix(),
+	signedNewToken, err := issueToken(apiCfg, userId, apiCfg.accessTokenTTL, tokenClaims{
+		TokenType: tokenTypeAccess,
+		SessionId: rotated.FamilyId,
 	})
-
-	signedNewToken, _ := newToken.SignedString(apiCfg.jwtSecret)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	// Create the response shape
 	response := struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}{
-		Token: signedNewToken,
+		Token:        signedNewToken,
+		RefreshToken: newRefreshToken,
 	}
 
 	// Convert the response to JSON
@@ -68,14 +91,28 @@ func refresh(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig)
 	w.Write(responseJSON)
 }
 
+// revoke accepts a refresh token, which ends its whole family, or an access token,
+// which is put on the revocation list until it expires. Anything else is rejected.
 func revoke(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
 
-	err := AddRevoke(db, tokenString)
+	claims, err := parseToken(apiCfg, tokenString, tokenTypeAccess)
+	if err == nil {
+		err = apiCfg.revocations.Revoke(db, claims.Id, time.Unix(claims.ExpiresAt, 0).UTC())
+	} else {
+		err = db.RevokeRefreshFamily(hashToken(tokenString), apiCfg.now())
+	}
+	if errors.Is(err, errInvalidToken) {
+		unauthorized(w, err)
+		return
+	}
 	if err != nil {
 		log.Print("Error occurred in revoke handler: " + err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
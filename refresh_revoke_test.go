@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+	env.createUser(t, "user@example.com")
+	_, stolen := loginTokens(t, router, "user@example.com")
+	otherAccess, otherRefresh := loginTokens(t, router, "user@example.com")
+
+	refreshed := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	rec := do(t, router, http.MethodPost, "/api/refresh", stolen, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d %s", rec.Code, rec.Body)
+	}
+	decodeBody(t, rec, &refreshed)
+	if refreshed.RefreshToken == stolen {
+		t.Fatal("the refresh token wasn't rotated")
+	}
+
+	// the rotated token comes back, so two parties hold the family
+	rec = do(t, router, http.MethodPost, "/api/refresh", stolen, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: got %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, http.MethodPost, "/api/refresh", refreshed.RefreshToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("newest refresh token of the family: got %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, http.MethodGet, "/api/sessions", refreshed.Token, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token of the family: got %d, want 401", rec.Code)
+	}
+
+	// other sessions aren't affected
+	if rec := do(t, router, http.MethodGet, "/api/sessions", otherAccess, nil); rec.Code != http.StatusOK {
+		t.Errorf("access token of another session: got %d, want 200", rec.Code)
+	}
+	if rec := do(t, router, http.MethodPost, "/api/refresh", otherRefresh, nil); rec.Code != http.StatusOK {
+		t.Errorf("refresh token of another session: got %d, want 200", rec.Code)
+	}
+}
+
+func TestRevokedAccessTokenRejected(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+	env.createUser(t, "user@example.com")
+	access, refreshToken := loginTokens(t, router, "user@example.com")
+
+	rec := do(t, router, http.MethodPost, "/api/revoke", access, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, router, http.MethodGet, "/api/sessions", access, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked access token: got %d, want 401", rec.Code)
+	}
+
+	// the revocation is stored, a restart doesn't bring the token back
+	revocations, err := newRevocationList(env.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.cfg.revocations = revocations
+	if rec := do(t, router, http.MethodGet, "/api/sessions", access, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked access token after a restart: got %d, want 401", rec.Code)
+	}
+
+	// only that access token is revoked, not the session
+	rec = do(t, router, http.MethodPost, "/api/refresh", refreshToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d %s", rec.Code, rec.Body)
+	}
+	refreshed := struct {
+		Token string `json:"token"`
+	}{}
+	decodeBody(t, rec, &refreshed)
+	if rec := do(t, router, http.MethodGet, "/api/sessions", refreshed.Token, nil); rec.Code != http.StatusOK {
+		t.Errorf("new access token of the session: got %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// revocationList is the in-memory front of the revoked token ids stored in the database,
+// so checking a token on every request never touches the file.
+type revocationList struct {
+	mux     *sync.RWMutex
+	entries map[string]time.Time
+}
+
+func newRevocationList(db *DB) (*revocationList, error) {
+	entries, err := db.GetRevocations()
+	if err != nil {
+		return nil, err
+	}
+	return &revocationList{
+		mux:     &sync.RWMutex{},
+		entries: entries,
+	}, nil
+}
+
+// Revoke stores the token id in the database and the set, expiresAt is the expiry of the token.
+func (list *revocationList) Revoke(db *DB, tokenId string, expiresAt time.Time) error {
+	idHash := hashToken(tokenId)
+	err := db.AddRevocation(idHash, expiresAt)
+	if err != nil {
+		return err
+	}
+	list.mux.Lock()
+	defer list.mux.Unlock()
+	list.entries[idHash] = expiresAt
+	return nil
+}
+
+func (list *revocationList) IsRevoked(tokenId string) bool {
+	list.mux.RLock()
+	defer list.mux.RUnlock()
+	_, found := list.entries[hashToken(tokenId)]
+	return found
+}
+
+func (list *revocationList) prune(now time.Time) {
+	list.mux.Lock()
+	defer list.mux.Unlock()
+	entries := map[string]time.Time{}
+	for key, expiresAt := range list.entries {
+		if expiresAt.After(now) {
+			entries[key] = expiresAt
+		}
+	}
+	list.entries = entries
+}
+
+// pruneRevocations periodically forgets revocations of tokens that have expired anyway.
+func pruneRevocations(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// keep entries around for the leeway, expired tokens are still accepted for that long
+		now := apiCfg.now().Add(-apiCfg.tokenLeeway)
+		apiCfg.revocations.prune(now)
+		err := db.PruneRevocations(now)
+		if err != nil {
+			log.Print("Error pruning revocations: " + err.Error())
+		}
+	}
+}
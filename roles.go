@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+
+	permAdminMetrics   = "admin:metrics"
+	permUsersManage    = "users:manage"
+	permChirpsModerate = "chirps:moderate"
+	permSettingsManage = "settings:manage"
+	permWebhooksManage = "webhooks:manage"
+)
+
+// rolePermissions lists what each role may do, a user has the permissions of all their roles.
+var rolePermissions = map[string][]string{
+	roleAdmin:     {permAdminMetrics, permUsersManage, permChirpsModerate, permSettingsManage, permWebhooksManage},
+	roleModerator: {permChirpsModerate},
+}
+
+var errUnknownRole = errors.New("unknown role")
+
+func validateRole(role string) error {
+	_, found := rolePermissions[role]
+	if !found {
+		return fmt.Errorf("%w %q", errUnknownRole, role)
+	}
+	return nil
+}
+
+func (user User) HasRole(role string) bool {
+	for _, val := range user.Roles {
+		if val == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (user User) HasPermission(permission string) bool {
+	for _, role := range user.Roles {
+		for _, val := range rolePermissions[role] {
+			if val == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principalCan reports whether the caller may use permission. Permissions come from the
+// user's roles, but only a full login can use them, never a scoped or third-party token,
+// and never before the user has set up two-factor authentication if they must.
+func principalCan(db *DB, principal Principal, permission string) (bool, error) {
+	if !principal.FullAccess() {
+		return false, nil
+	}
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		return false, err
+	}
+	if twoFactorRequired(user) && !user.TOTPEnabled {
+		return false, nil
+	}
+	return user.HasPermission(permission), nil
+}
+
+// middlewarePermission requires a full login of a user whose roles grant permission.
+func (cfg *apiConfig) middlewarePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return cfg.middlewareAuthRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := principalFromContext(r.Context())
+			allowed, err := principalCan(cfg.db, principal, permission)
+			if err != nil {
+				unauthorized(w, err)
+				return
+			}
+			if !allowed {
+				http.Error(w, "this requires the "+permission+" permission", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+func adminUserFromURL(w http.ResponseWriter, r *http.Request, db *DB) (User, bool) {
+	numericId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return User{}, false
+	}
+	user, err := GetUserById(db, numericId)
+	if err != nil {
+		http.NotFound(w, r)
+		return User{}, false
+	}
+	return user, true
+}
+
+func adminRolesGrant(w http.ResponseWriter, r *http.Request, db *DB) {
+	user, ok := adminUserFromURL(w, r, db)
+	if !ok {
+		return
+	}
+	role := chi.URLParam(r, "role")
+	err := validateRole(role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err = db.GrantRole(user.Id, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Id    int      `json:"id"`
+		Roles []string `json:"roles"`
+	}{
+		Id:    user.Id,
+		Roles: user.Roles,
+	})
+}
+
+func adminRolesRevoke(w http.ResponseWriter, r *http.Request, db *DB) {
+	user, ok := adminUserFromURL(w, r, db)
+	if !ok {
+		return
+	}
+	role := chi.URLParam(r, "role")
+	principal, _ := principalFromContext(r.Context())
+	// an admin removing their own admin role could leave nobody able to grant it back
+	if role == roleAdmin && user.Id == principal.UserId {
+		http.Error(w, "admins can't revoke their own admin role", http.StatusBadRequest)
+		return
+	}
+	user, err := db.RevokeRole(user.Id, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Id    int      `json:"id"`
+		Roles []string `json:"roles"`
+	}{
+		Id:    user.Id,
+		Roles: user.Roles,
+	})
+}
+
+// adminRequire2FA makes a user unable to get full tokens until they enroll in TOTP.
+func adminRequire2FA(w http.ResponseWriter, r *http.Request, db *DB) {
+	user, ok := adminUserFromURL(w, r, db)
+	if !ok {
+		return
+	}
+	required := r.Method != http.MethodDelete
+	err := db.SetRequire2FA(user.Id, required)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runUsersCommand runs "chirpy users grant-role|revoke-role <email> <role>",
+// which is how the first admin gets made.
+func runUsersCommand(db *DB, args []string, out io.Writer) error {
+	usage := errors.New("usage: chirpy users grant-role|revoke-role <email> <role>")
+	if len(args) != 3 {
+		return usage
+	}
+	command, email, role := args[0], args[1], args[2]
+
+	user, err := GetUser(db, email)
+	if err != nil {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	switch command {
+	case "grant-role":
+		err = validateRole(role)
+		if err != nil {
+			return err
+		}
+		user, err = db.GrantRole(user.Id, role)
+	case "revoke-role":
+		user, err = db.RevokeRole(user.Id, role)
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+	roles := append([]string{}, user.Roles...)
+	sort.Strings(roles)
+	fmt.Fprintf(out, "%s now has roles: %v\n", user.Email, roles)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func rolesRouter(env *testEnv) http.Handler {
+	r := chi.NewRouter()
+	r.With(env.cfg.middlewarePermission(permUsersManage)).Put("/admin/users/{userID}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		adminRolesGrant(w, r, env.db)
+	})
+	r.With(env.cfg.middlewarePermission(permUsersManage)).Delete("/admin/users/{userID}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		adminRolesRevoke(w, r, env.db)
+	})
+	return r
+}
+
+// createAdmin adds a user with the admin role and the two-factor setup admins need.
+func (env *testEnv) createAdmin(t *testing.T, email string) User {
+	t.Helper()
+	user := env.createUser(t, email)
+	user, err := env.db.GrantRole(user.Id, roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollTOTP(t, env, user)
+	return user
+}
+
+func TestAdminRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		actor  string
+		method string
+		target string
+		role   string
+		status int
+		roles  []string
+	}{
+		{name: "grant", actor: "admin", method: http.MethodPut, target: "user", role: roleModerator, status: http.StatusOK, roles: []string{roleModerator}},
+		{name: "grant twice", actor: "admin", method: http.MethodPut, target: "moderator", role: roleModerator, status: http.StatusOK, roles: []string{roleModerator}},
+		{name: "grant an unknown role", actor: "admin", method: http.MethodPut, target: "user", role: "owner", status: http.StatusBadRequest},
+		{name: "grant to an unknown user", actor: "admin", method: http.MethodPut, target: "missing", role: roleModerator, status: http.StatusNotFound},
+		{name: "revoke", actor: "admin", method: http.MethodDelete, target: "moderator", role: roleModerator, status: http.StatusOK, roles: []string{}},
+		{name: "revoke another admin", actor: "admin", method: http.MethodDelete, target: "other admin", role: roleAdmin, status: http.StatusOK, roles: []string{}},
+		{name: "revoke own admin role", actor: "admin", method: http.MethodDelete, target: "admin", role: roleAdmin, status: http.StatusBadRequest, roles: []string{roleAdmin}},
+		{name: "moderator can't grant", actor: "moderator", method: http.MethodPut, target: "moderator", role: roleAdmin, status: http.StatusForbidden, roles: []string{roleModerator}},
+		{name: "user can't revoke", actor: "user", method: http.MethodDelete, target: "moderator", role: roleModerator, status: http.StatusForbidden, roles: []string{roleModerator}},
+		{name: "admin without two-factor", actor: "new admin", method: http.MethodPut, target: "user", role: roleModerator, status: http.StatusForbidden, roles: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := rolesRouter(env)
+			users := map[string]User{
+				"admin":       env.createAdmin(t, "admin@example.com"),
+				"other admin": env.createAdmin(t, "other-admin@example.com"),
+				"moderator":   env.createUser(t, "moderator@example.com"),
+				"user":        env.createUser(t, "user@example.com"),
+				"new admin":   env.createUser(t, "new-admin@example.com"),
+			}
+			for name, role := range map[string]string{"moderator": roleModerator, "new admin": roleAdmin} {
+				_, err := env.db.GrantRole(users[name].Id, role)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			targetId := 1000
+			if target, found := users[tt.target]; found {
+				targetId = target.Id
+			}
+			path := "/admin/users/" + strconv.Itoa(targetId) + "/roles/" + tt.role
+			rec := do(t, router, tt.method, path, env.accessToken(t, users[tt.actor]), nil)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+			if tt.roles == nil {
+				return
+			}
+			user, err := GetUserById(env.db, targetId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(user.Roles) != len(tt.roles) || (len(tt.roles) > 0 && user.Roles[0] != tt.roles[0]) {
+				t.Errorf("got roles %v, want %v", user.Roles, tt.roles)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxScheduleAhead is how far in the future a chirp can be scheduled.
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// ScheduledChirp is a chirp waiting to be published, it gets a chirp id when it is.
+type ScheduledChirp struct {
+	Id        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorId  int       `json:"author_id"`
+	MediaIds  []string  `json:"media_ids,omitempty"`
+	PublishAt time.Time `json:"publish_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// scheduleChirp stores an already validated chirp to be published at publishAt.
+func scheduleChirp(w http.ResponseWriter, db *DB, apiCfg *apiConfig, user User, body string, mediaIds []string, publishAt time.Time) {
+	if !apiCfg.can(user, featureScheduledChirps) {
+		http.Error(w, errFeatureNotInPlan.Error(), http.StatusForbidden)
+		return
+	}
+	now := apiCfg.now()
+	if !publishAt.After(now) {
+		http.Error(w, "publish_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if publishAt.After(now.Add(maxScheduleAhead)) {
+		http.Error(w, "chirps can be scheduled at most a year ahead", http.StatusBadRequest)
+		return
+	}
+	scheduled, err := db.CreateScheduledChirp(ScheduledChirp{
+		Body:      body,
+		AuthorId:  user.Id,
+		MediaIds:  mediaIds,
+		PublishAt: publishAt.UTC(),
+		CreatedAt: now,
+	})
+	if err != nil {
+		log.Print("Error scheduling chirp: " + err.Error())
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, scheduled)
+}
+
+// scheduledChirpsGet lists the caller's chirps that are still waiting, soonest first.
+func scheduledChirpsGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	scheduled, err := db.GetScheduledChirpsByAuthor(principal.UserId)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].PublishAt.Before(scheduled[j].PublishAt)
+	})
+	respondWithJSON(w, http.StatusOK, scheduled)
+}
+
+// scheduledChirpsDelete cancels a scheduled chirp, someone else's is a 404.
+func scheduledChirpsDelete(w http.ResponseWriter, r *http.Request, db *DB) {
+	numericId, err := strconv.Atoi(chi.URLParam(r, "scheduledID"))
+	if err != nil {
+		http.Error(w, "Invalid scheduled chirp ID", http.StatusBadRequest)
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+	err = db.DeleteScheduledChirp(numericId, principal.UserId)
+	if errors.Is(err, errChirpNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishScheduledChirps periodically publishes the scheduled chirps that are due.
+// Whether the author may schedule is checked when scheduling, a chirp scheduled
+// before a subscription lapsed is still published.
+func publishScheduledChirps(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		chirps, err := db.PublishDueChirps(apiCfg.now())
+		if err != nil {
+			log.Print("Error publishing scheduled chirps: " + err.Error())
+			continue
+		}
+		for _, chirp := range chirps {
+			log.Printf("Published scheduled chirp %d", chirp.Id)
+			apiCfg.emitEvent(eventChirpCreated, chirp)
+		}
+	}
+}
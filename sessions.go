@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// createSession records a new login from the request's client, clientId is the
+// OAuth app the login was for, if any.
+func createSession(db *DB, apiCfg *apiConfig, r *http.Request, userId int, clientId string) (Session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return Session{}, err
+	}
+	now := apiCfg.now()
+	session := Session{
+		Id:         id,
+		UserId:     userId,
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ClientId:   clientId,
+	}
+	err = db.CreateSession(session)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func sessionsGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	sessions, err := db.ListSessions(principal.UserId)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	// most recently used first
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	type sessionResponse struct {
+		Session
+		Current bool `json:"current"`
+	}
+	response := []sessionResponse{}
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			Session: session,
+			Current: session.Id == principal.SessionId,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func sessionDelete(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	err := db.RevokeSession(principal.UserId, chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func logoutAll(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	err := db.RevokeAllSessions(principal.UserId)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+	env.createUser(t, "user@example.com")
+	laptop, _ := loginTokens(t, router, "user@example.com")
+	phone, phoneRefresh := loginTokens(t, router, "user@example.com")
+	tablet, _ := loginTokens(t, router, "user@example.com")
+
+	rec := do(t, router, http.MethodGet, "/api/sessions", laptop, nil)
+	sessions := []struct {
+		Id      string `json:"id"`
+		Current bool   `json:"current"`
+	}{}
+	decodeBody(t, rec, &sessions)
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, want 3", len(sessions))
+	}
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("got %d current sessions, want 1", current)
+	}
+
+	// ending the phone's session from the laptop
+	claims, err := parseToken(env.cfg, phone, tokenTypeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = do(t, router, http.MethodDelete, "/api/sessions/"+claims.SessionId, laptop, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete session: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, router, http.MethodGet, "/api/sessions", phone, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token of the ended session: got %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, http.MethodPost, "/api/refresh", phoneRefresh, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token of the ended session: got %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, http.MethodDelete, "/api/sessions/unknown", laptop, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("delete an unknown session: got %d, want 404", rec.Code)
+	}
+
+	rec = do(t, router, http.MethodPost, "/api/logout-all", laptop, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout-all: got %d %s", rec.Code, rec.Body)
+	}
+	for name, token := range map[string]string{"laptop": laptop, "tablet": tablet} {
+		if rec := do(t, router, http.MethodGet, "/api/sessions", token, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s after logout-all: got %d, want 401", name, rec.Code)
+		}
+	}
+}
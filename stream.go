@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamChirpCreated = "chirp.created"
+	streamChirpUpdated = "chirp.updated"
+	streamChirpDeleted = "chirp.deleted"
+
+	// streamReplaySize is how many recent events a reconnecting client can resume from
+	streamReplaySize = 1000
+	// streamBufferSize is how far a client may fall behind before it is dropped
+	streamBufferSize = 64
+	streamHeartbeat  = 15 * time.Second
+)
+
+type busEvent struct {
+	Id    uint64
+	Type  string
+	Chirp Chirp
+}
+
+// busSubscriber receives published events until it unsubscribes, or until it falls
+// more than streamBufferSize events behind and the bus drops it by closing dropped.
+type busSubscriber struct {
+	events  chan busEvent
+	dropped chan struct{}
+}
+
+// chirpBus is the in-process pub/sub of chirp changes, it keeps the latest events so
+// streams can resume after a reconnect.
+type chirpBus struct {
+	mux         *sync.Mutex
+	lastId      uint64
+	replay      []busEvent
+	subscribers map[*busSubscriber]bool
+}
+
+func newChirpBus() *chirpBus {
+	return &chirpBus{
+		mux:         &sync.Mutex{},
+		replay:      []busEvent{},
+		subscribers: map[*busSubscriber]bool{},
+	}
+}
+
+// Publish sends an event to every subscriber without waiting for any of them. A nil
+// bus drops the event, the CLI uses the database without one.
+func (bus *chirpBus) Publish(eventType string, chirp Chirp) {
+	if bus == nil {
+		return
+	}
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	bus.lastId++
+	event := busEvent{Id: bus.lastId, Type: eventType, Chirp: chirp}
+	bus.replay = append(bus.replay, event)
+	if len(bus.replay) > streamReplaySize {
+		bus.replay = bus.replay[len(bus.replay)-streamReplaySize:]
+	}
+	for sub := range bus.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			delete(bus.subscribers, sub)
+			close(sub.dropped)
+		}
+	}
+}
+
+// Subscribe registers a subscriber. When resuming it also returns the buffered events
+// after lastId, and false if some of them are no longer buffered, or lastId is from
+// before a restart, so the client knows it missed events.
+func (bus *chirpBus) Subscribe(lastId uint64, resume bool) (*busSubscriber, []busEvent, bool) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	sub := &busSubscriber{
+		events:  make(chan busEvent, streamBufferSize),
+		dropped: make(chan struct{}),
+	}
+	bus.subscribers[sub] = true
+	if !resume {
+		return sub, nil, true
+	}
+	missed := []busEvent{}
+	for _, event := range bus.replay {
+		if event.Id > lastId {
+			missed = append(missed, event)
+		}
+	}
+	complete := lastId <= bus.lastId
+	if len(bus.replay) > 0 && bus.replay[0].Id > lastId+1 {
+		complete = false
+	}
+	return sub, missed, complete
+}
+
+func (bus *chirpBus) Unsubscribe(sub *busSubscriber) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+	delete(bus.subscribers, sub)
+}
+
+// chirpFilter decides which events a stream gets, unset fields match everything.
+type chirpFilter struct {
+	authorId int
+	hashtag  string
+	// authors is set for the home timeline, the user and whoever they follow
+	authors map[int]bool
+}
+
+func (filter chirpFilter) Matches(chirp Chirp) bool {
+	if filter.authorId != 0 && chirp.AuthorId != filter.authorId {
+		return false
+	}
+	if filter.authors != nil && !filter.authors[chirp.AuthorId] {
+		return false
+	}
+	if filter.hashtag != "" && !hasHashtag(chirp.Body, filter.hashtag) {
+		return false
+	}
+	return true
+}
+
+// hasHashtag reports whether body contains #tag as a word, ignoring case and trailing punctuation.
+func hasHashtag(body string, tag string) bool {
+	for _, word := range strings.Fields(body) {
+		word = strings.TrimRight(word, ".,;:!?)\"'")
+		if strings.EqualFold(word, "#"+tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeStreamEvent(w http.ResponseWriter, event busEvent) error {
+	var data interface{} = event.Chirp
+	if event.Type == streamChirpDeleted {
+		// deleted chirps are gone, clients only need to know which one to remove
+		data = struct {
+			Id       int `json:"id"`
+			AuthorId int `json:"author_id"`
+		}{
+			Id:       event.Chirp.Id,
+			AuthorId: event.Chirp.AuthorId,
+		}
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, payload)
+	return err
+}
+
+// chirpsStream sends new, edited and deleted chirps as Server-Sent Events. It takes the same
+// author_id filter as GET /api/chirps, plus hashtag and timeline=home, which needs a
+// token. Reconnecting clients send Last-Event-ID and get what they missed, or a reset
+// event when too much happened to replay and they should refetch instead.
+func chirpsStream(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := chirpFilter{}
+	query := r.URL.Query()
+	if query.Get("author_id") != "" {
+		authorId, err := strconv.Atoi(query.Get("author_id"))
+		if err != nil {
+			http.Error(w, "Invalid author ID", http.StatusBadRequest)
+			return
+		}
+		filter.authorId = authorId
+	}
+	filter.hashtag = strings.TrimPrefix(query.Get("hashtag"), "#")
+	switch query.Get("timeline") {
+	case "":
+	case "home":
+		principal, found := principalFromContext(r.Context())
+		if !found {
+			unauthorized(w, errInvalidToken)
+			return
+		}
+		followees, err := db.GetFollowees(principal.UserId)
+		if err != nil {
+			http.Error(w, "Database problem", http.StatusInternalServerError)
+			return
+		}
+		filter.authors = map[int]bool{principal.UserId: true}
+		for _, id := range followees {
+			filter.authors[id] = true
+		}
+	default:
+		http.Error(w, "timeline must be home", http.StatusBadRequest)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		// EventSource can't set headers on the first request, so a query parameter works too
+		lastEventId = query.Get("last_event_id")
+	}
+	resume := lastEventId != ""
+	lastId, err := strconv.ParseUint(lastEventId, 10, 64)
+	if resume && err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	sub, missed, complete := db.events.Subscribe(lastId, resume)
+	defer db.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		if filter.Matches(event.Chirp) {
+			writeStreamEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.dropped:
+			fmt.Fprint(w, "event: dropped\ndata: {\"reason\":\"the client fell too far behind, reconnect with Last-Event-ID\"}\n\n")
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case event := <-sub.events:
+			if !filter.Matches(event.Chirp) {
+				continue
+			}
+			err := writeStreamEvent(w, event)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
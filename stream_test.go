@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// resumeStream connects to the stream with Last-Event-ID and returns what it sent
+// before the connection was closed.
+func resumeStream(t *testing.T, env *testEnv, query string, lastEventId string, token string) string {
+	t.Helper()
+	router := chi.NewRouter()
+	router.With(env.cfg.middlewareAuthOptional).Get("/api/stream/chirps", func(w http.ResponseWriter, r *http.Request) {
+		chirpsStream(w, r, env.db, env.cfg)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	// the stream writes what it replays, then sees the client is gone
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/api/stream/chirps"+query, nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", lastEventId)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestStreamReplaysAfterLastEventId(t *testing.T) {
+	env := newTestEnv(t)
+	author := env.createUser(t, "author@example.com")
+	for _, body := range []string{"first", "second", "third"} {
+		_, err := env.db.CreateChirp(body, author.Id, nil, env.cfg.now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := resumeStream(t, env, "", "1", "")
+	if strings.Contains(body, "first") || !strings.Contains(body, "second") || !strings.Contains(body, "third") {
+		t.Errorf("got %q, want the chirps after event 1", body)
+	}
+	if strings.Contains(body, "event: reset") {
+		t.Errorf("got a reset, every missed event was buffered: %q", body)
+	}
+}
+
+func TestStreamResetsWhenEventsAreGone(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventId string
+	}{
+		{name: "fell out of the buffer", lastEventId: "1"},
+		{name: "from before a restart", lastEventId: strconv.Itoa(streamReplaySize * 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			for i := 0; i < streamReplaySize+2; i++ {
+				env.db.events.Publish(streamChirpCreated, Chirp{Id: i + 1, Body: "chirp"})
+			}
+			body := resumeStream(t, env, "", tt.lastEventId, "")
+			if !strings.Contains(body, "event: reset\n") {
+				t.Error("got no reset event")
+			}
+		})
+	}
+}
+
+func TestStreamDropsSlowConsumer(t *testing.T) {
+	bus := newChirpBus()
+	slow, _, _ := bus.Subscribe(0, false)
+	fast, _, _ := bus.Subscribe(0, false)
+	for i := 0; i < streamBufferSize+1; i++ {
+		bus.Publish(streamChirpCreated, Chirp{Id: i + 1})
+		<-fast.events
+	}
+
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatal("the slow consumer wasn't dropped")
+	}
+	select {
+	case <-fast.dropped:
+		t.Fatal("a consumer that kept up was dropped")
+	default:
+	}
+	if bus.subscribers[slow] || !bus.subscribers[fast] {
+		t.Errorf("got subscribers %v", bus.subscribers)
+	}
+}
+
+func TestStreamGetsEditsAndRestores(t *testing.T) {
+	env := newTestEnv(t)
+	author := env.createUser(t, "author@example.com")
+	chirp, err := env.db.CreateChirp("hello", author.Id, nil, env.cfg.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, _ := env.db.events.Subscribe(0, false)
+	defer env.db.events.Unsubscribe(sub)
+
+	_, err = env.db.EditChirp(chirp.Id, "hello again", env.cfg.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.db.SoftDeleteChirp(chirp.Id, env.cfg.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.db.RestoreChirp(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{streamChirpUpdated, streamChirpDeleted, streamChirpCreated} {
+		select {
+		case event := <-sub.events:
+			if event.Type != want || event.Chirp.Id != chirp.Id {
+				t.Errorf("got %s of chirp %d, want %s", event.Type, event.Chirp.Id, want)
+			}
+		default:
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestStreamHomeTimeline(t *testing.T) {
+	env := newTestEnv(t)
+	reader := env.createUser(t, "reader@example.com")
+	followed := env.createUser(t, "followed@example.com")
+	stranger := env.createUser(t, "stranger@example.com")
+	err := env.db.Follow(reader.Id, followed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []User{reader, followed, stranger} {
+		_, err = env.db.CreateChirp("chirp by "+user.Email, user.Id, nil, env.cfg.now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := resumeStream(t, env, "?timeline=home", "0", env.accessToken(t, reader))
+	if !strings.Contains(body, "chirp by reader@") || !strings.Contains(body, "chirp by followed@") {
+		t.Errorf("got %q, want the reader's chirps and the chirps they follow", body)
+	}
+	if strings.Contains(body, "chirp by stranger@") {
+		t.Errorf("got %q, want no chirps from users they don't follow", body)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	subscriptionActive = "active"
+	// past_due subscriptions keep their benefits until the grace period is over
+	subscriptionPastDue = "past_due"
+	// canceled subscriptions stay paid up until the end of the current period but won't renew
+	subscriptionCanceled = "canceled"
+	subscriptionRefunded = "refunded"
+	subscriptionExpired  = "expired"
+
+	defaultPlan = "red"
+	// subscriptionPeriod is used when Polka doesn't say when the paid period ends
+	subscriptionPeriod = 30 * 24 * time.Hour
+
+	polkaEventUpgraded      = "user.upgraded"
+	polkaEventDowngraded    = "user.downgraded"
+	polkaEventRenewed       = "subscription.renewed"
+	polkaEventPaymentFailed = "subscription.payment_failed"
+	polkaEventRefunded      = "subscription.refunded"
+	polkaEventCanceled      = "subscription.canceled"
+	// subscriptionLapsed is recorded by us, not Polka, when a period ends without renewal
+	subscriptionLapsed = "lapsed"
+)
+
+// Subscription is a user's Chirpy Red membership as last reported by Polka.
+type Subscription struct {
+	Plan             string    `json:"plan"`
+	Status           string    `json:"status"`
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+	// GraceUntil is set while a payment failed and Polka retries it
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// SubscriptionChange is one entry of a user's subscription history, kept for support.
+type SubscriptionChange struct {
+	UserId           int       `json:"user_id"`
+	At               time.Time `json:"at"`
+	Event            string    `json:"event"`
+	EventId          string    `json:"event_id,omitempty"`
+	FromStatus       string    `json:"from_status"`
+	ToStatus         string    `json:"to_status"`
+	Plan             string    `json:"plan"`
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+}
+
+// polkaEventData is the data of a Polka event, only user_id is always set.
+type polkaEventData struct {
+	UserId int    `json:"user_id"`
+	Plan   string `json:"plan"`
+	// CurrentPeriodEnd is in unix seconds
+	CurrentPeriodEnd int64 `json:"current_period_end"`
+}
+
+// isSubscriptionEvent reports whether a Polka event is about Chirpy Red, other events are ignored.
+func isSubscriptionEvent(event string) bool {
+	switch event {
+	case polkaEventUpgraded, polkaEventDowngraded, polkaEventRenewed, polkaEventPaymentFailed, polkaEventRefunded, polkaEventCanceled:
+		return true
+	}
+	return false
+}
+
+// Active reports whether the subscription currently grants Chirpy Red, a nil subscription never does.
+func (sub *Subscription) Active(now time.Time) bool {
+	if sub == nil {
+		return false
+	}
+	switch sub.Status {
+	case subscriptionActive, subscriptionCanceled:
+		return now.Before(sub.CurrentPeriodEnd)
+	case subscriptionPastDue:
+		return sub.GraceUntil != nil && now.Before(*sub.GraceUntil)
+	}
+	return false
+}
+
+func (user User) IsChirpyRed(now time.Time) bool {
+	return user.Subscription.Active(now)
+}
+
+// nextSubscription applies a Polka event to the current subscription, which may be nil.
+// It returns false when the event doesn't change anything, like a cancellation of a
+// subscription that doesn't exist. Events can arrive out of order, so a period end
+// never moves back because of a late upgrade or renewal.
+func nextSubscription(current *Subscription, event string, data polkaEventData, now time.Time, grace time.Duration) (Subscription, bool) {
+	periodEnd := time.Time{}
+	if data.CurrentPeriodEnd > 0 {
+		periodEnd = time.Unix(data.CurrentPeriodEnd, 0).UTC()
+	}
+
+	if event == polkaEventUpgraded || event == polkaEventRenewed {
+		next := Subscription{Plan: defaultPlan}
+		start := now
+		if current != nil {
+			next.Plan = current.Plan
+			if current.CurrentPeriodEnd.After(now) {
+				start = current.CurrentPeriodEnd
+			}
+		}
+		if data.Plan != "" {
+			next.Plan = data.Plan
+		}
+		if periodEnd.IsZero() {
+			periodEnd = start.Add(subscriptionPeriod)
+		}
+		if current != nil && current.CurrentPeriodEnd.After(periodEnd) {
+			periodEnd = current.CurrentPeriodEnd
+		}
+		next.Status = subscriptionActive
+		next.CurrentPeriodEnd = periodEnd
+		next.UpdatedAt = now
+		return next, true
+	}
+
+	if current == nil {
+		return Subscription{}, false
+	}
+	next := *current
+	next.UpdatedAt = now
+	switch event {
+	case polkaEventPaymentFailed:
+		if current.Status != subscriptionActive && current.Status != subscriptionPastDue {
+			return Subscription{}, false
+		}
+		if current.Status == subscriptionActive {
+			graceStart := now
+			if current.CurrentPeriodEnd.After(now) {
+				graceStart = current.CurrentPeriodEnd
+			}
+			graceUntil := graceStart.Add(grace)
+			next.GraceUntil = &graceUntil
+		}
+		next.Status = subscriptionPastDue
+	case polkaEventCanceled:
+		if current.Status != subscriptionActive && current.Status != subscriptionPastDue {
+			return Subscription{}, false
+		}
+		next.Status = subscriptionCanceled
+		next.GraceUntil = nil
+	case polkaEventRefunded, polkaEventDowngraded:
+		if current.Status == subscriptionRefunded || (event == polkaEventDowngraded && current.Status == subscriptionExpired) {
+			return Subscription{}, false
+		}
+		next.Status = subscriptionExpired
+		if event == polkaEventRefunded {
+			next.Status = subscriptionRefunded
+		}
+		next.GraceUntil = nil
+		if next.CurrentPeriodEnd.After(now) {
+			next.CurrentPeriodEnd = now
+		}
+	default:
+		return Subscription{}, false
+	}
+	return next, true
+}
+
+// lapseSubscriptions periodically expires memberships whose period or grace period is
+// over, membership is already checked against the clock, this records it in the history.
+func lapseSubscriptions(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		userIds, err := db.LapseSubscriptions(apiCfg.now())
+		if err != nil {
+			log.Print("Error lapsing subscriptions: " + err.Error())
+			continue
+		}
+		for _, userId := range userIds {
+			apiCfg.plans.Forget(userId)
+		}
+		if len(userIds) > 0 {
+			log.Printf("Lapsed subscriptions: %v", userIds)
+		}
+	}
+}
+
+// adminSubscriptionGet shows a user's subscription and every change to it, newest last.
+func adminSubscriptionGet(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	user, ok := adminUserFromURL(w, r, db)
+	if !ok {
+		return
+	}
+	history, err := db.GetSubscriptionHistory(user.Id)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Id            int                  `json:"id"`
+		Is_Chirpy_Red bool                 `json:"is_chirpy_red"`
+		Subscription  *Subscription        `json:"subscription"`
+		History       []SubscriptionChange `json:"history"`
+	}{
+		Id:            user.Id,
+		Is_Chirpy_Red: user.IsChirpyRed(apiCfg.now()),
+		Subscription:  user.Subscription,
+		History:       history,
+	})
+}
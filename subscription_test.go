@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSubscription(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	grace := 3 * 24 * time.Hour
+	day := 24 * time.Hour
+	at := func(d time.Duration) *time.Time {
+		val := now.Add(d)
+		return &val
+	}
+	unix := func(d time.Duration) int64 {
+		return now.Add(d).Unix()
+	}
+
+	tests := []struct {
+		name    string
+		current *Subscription
+		event   string
+		data    polkaEventData
+		// want is nil when the event changes nothing
+		want *Subscription
+	}{
+		{
+			name:  "first upgrade",
+			event: polkaEventUpgraded,
+			want:  &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(subscriptionPeriod)},
+		},
+		{
+			name:  "upgrade with a plan and period end",
+			event: polkaEventUpgraded,
+			data:  polkaEventData{Plan: "red-yearly", CurrentPeriodEnd: unix(365 * day)},
+			want:  &Subscription{Plan: "red-yearly", Status: subscriptionActive, CurrentPeriodEnd: now.Add(365 * day)},
+		},
+		{
+			name:    "renewal extends the current period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(10 * day)},
+			event:   polkaEventRenewed,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(10*day + subscriptionPeriod)},
+		},
+		{
+			name:    "renewal with a period end",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(10 * day)},
+			event:   polkaEventRenewed,
+			data:    polkaEventData{CurrentPeriodEnd: unix(40 * day)},
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(40 * day)},
+		},
+		{
+			name:    "late renewal doesn't shorten the period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(40 * day)},
+			event:   polkaEventRenewed,
+			data:    polkaEventData{CurrentPeriodEnd: unix(10 * day)},
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(40 * day)},
+		},
+		{
+			name:    "late upgrade doesn't shorten the period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(40 * day)},
+			event:   polkaEventUpgraded,
+			data:    polkaEventData{CurrentPeriodEnd: unix(10 * day)},
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(40 * day)},
+		},
+		{
+			name:    "upgrade after the period ended",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionExpired, CurrentPeriodEnd: now.Add(-5 * day)},
+			event:   polkaEventUpgraded,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(subscriptionPeriod)},
+		},
+		{
+			name:    "renewal ends the grace period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(-day), GraceUntil: at(2 * day)},
+			event:   polkaEventRenewed,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(subscriptionPeriod)},
+		},
+		{
+			name:    "failed payment starts the grace period at the period end",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(day)},
+			event:   polkaEventPaymentFailed,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(day), GraceUntil: at(day + grace)},
+		},
+		{
+			name:    "another failed payment keeps the grace period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(-day), GraceUntil: at(2 * day)},
+			event:   polkaEventPaymentFailed,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(-day), GraceUntil: at(2 * day)},
+		},
+		{
+			name:    "failed payment of a canceled subscription",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionCanceled, CurrentPeriodEnd: now.Add(day)},
+			event:   polkaEventPaymentFailed,
+		},
+		{
+			name:    "cancel keeps the paid period",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(day), GraceUntil: at(day + grace)},
+			event:   polkaEventCanceled,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionCanceled, CurrentPeriodEnd: now.Add(day)},
+		},
+		{
+			name:  "cancel without a subscription",
+			event: polkaEventCanceled,
+		},
+		{
+			name:    "refund ends the period now",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(10 * day)},
+			event:   polkaEventRefunded,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionRefunded, CurrentPeriodEnd: now},
+		},
+		{
+			name:    "second refund",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionRefunded, CurrentPeriodEnd: now.Add(-day)},
+			event:   polkaEventRefunded,
+		},
+		{
+			name:    "downgrade ends the period now",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionPastDue, CurrentPeriodEnd: now.Add(day), GraceUntil: at(day + grace)},
+			event:   polkaEventDowngraded,
+			want:    &Subscription{Plan: defaultPlan, Status: subscriptionExpired, CurrentPeriodEnd: now},
+		},
+		{
+			name:    "downgrade of an expired subscription",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionExpired, CurrentPeriodEnd: now.Add(-day)},
+			event:   polkaEventDowngraded,
+		},
+		{
+			name:    "unknown event",
+			current: &Subscription{Plan: defaultPlan, Status: subscriptionActive, CurrentPeriodEnd: now.Add(day)},
+			event:   "user.renamed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := nextSubscription(tt.current, tt.event, tt.data, now, grace)
+			if tt.want == nil {
+				if changed {
+					t.Fatalf("got %+v, want no change", got)
+				}
+				return
+			}
+			if !changed {
+				t.Fatal("got no change")
+			}
+			if got.Plan != tt.want.Plan || got.Status != tt.want.Status || !got.CurrentPeriodEnd.Equal(tt.want.CurrentPeriodEnd) {
+				t.Errorf("got %s %s until %v, want %s %s until %v", got.Plan, got.Status, got.CurrentPeriodEnd, tt.want.Plan, tt.want.Status, tt.want.CurrentPeriodEnd)
+			}
+			if (got.GraceUntil == nil) != (tt.want.GraceUntil == nil) || (got.GraceUntil != nil && !got.GraceUntil.Equal(*tt.want.GraceUntil)) {
+				t.Errorf("got grace until %v, want %v", got.GraceUntil, tt.want.GraceUntil)
+			}
+			if !got.UpdatedAt.Equal(now) {
+				t.Errorf("updated at %v, want %v", got.UpdatedAt, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// personal access tokens start with this prefix so they are easy to spot in logs and secret scanners
+const apiTokenPrefix = "chirpy_pat_"
+
+const maxAPITokenNameLength = 64
+
+// apiTokenPrincipal authenticates a request made with a personal access token.
+func apiTokenPrincipal(apiCfg *apiConfig, tokenString string) (Principal, error) {
+	secretHash := hashToken(tokenString)
+	now := apiCfg.now()
+	token, err := apiCfg.db.GetAPIToken(secretHash, now)
+	if err != nil {
+		return Principal{}, err
+	}
+	// tokens of deleted accounts stop working, and work again if the account is restored
+	user, err := GetUserById(apiCfg.db, token.UserId)
+	if err != nil || user.DeletedAt != nil {
+		return Principal{}, errInvalidToken
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > sessionTouchInterval {
+		err = apiCfg.db.TouchAPIToken(secretHash, now)
+		if err != nil {
+			return Principal{}, err
+		}
+	}
+	return Principal{
+		UserId: token.UserId,
+		Scopes: token.Scopes,
+	}, nil
+}
+
+func apiTokensPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+
+	type requestBodyParams struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(bodyFetched.Name)
+	if name == "" || len(name) > maxAPITokenNameLength {
+		http.Error(w, "name must be 1-64 characters", http.StatusBadRequest)
+		return
+	}
+	// a token always has at least one scope, a token without scopes would have full access
+	if len(bodyFetched.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range bodyFetched.Scopes {
+		if !knownScopes[scope] {
+			http.Error(w, "unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rawToken := apiTokenPrefix + secret
+
+	now := apiCfg.now()
+	token := APIToken{
+		Id:        id[:16],
+		UserId:    principal.UserId,
+		Name:      name,
+		Scopes:    bodyFetched.Scopes,
+		CreatedAt: now,
+	}
+	if bodyFetched.ExpiresInDays > 0 {
+		expiresAt := now.Add(time.Duration(bodyFetched.ExpiresInDays) * 24 * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+	err = db.CreateAPIToken(hashToken(rawToken), token)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+
+	// this is the only time the secret is ever shown
+	respondWithJSON(w, http.StatusCreated, struct {
+		APIToken
+		Token string `json:"token"`
+	}{
+		APIToken: token,
+		Token:    rawToken,
+	})
+}
+
+func apiTokensGet(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	tokens, err := db.ListAPITokens(principal.UserId)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+func apiTokenDelete(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	err := db.RevokeAPIToken(principal.UserId, chi.URLParam(r, "tokenID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	router := chi.NewRouter()
+	router.With(env.cfg.middlewareFullAccess).Post("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		apiTokensPost(w, r, env.db, env.cfg)
+	})
+	router.With(env.cfg.middlewareFullAccess).Delete("/api/tokens/{tokenID}", func(w http.ResponseWriter, r *http.Request) {
+		apiTokenDelete(w, r, env.db)
+	})
+	router.With(env.cfg.middlewareScope(scopeChirpsWrite)).Post("/api/chirps", func(w http.ResponseWriter, r *http.Request) {
+		chirpsPost(w, r, env.db, env.cfg)
+	})
+	login := env.accessToken(t, user)
+	createToken := func(scopes ...string) (string, string) {
+		t.Helper()
+		rec := do(t, router, http.MethodPost, "/api/tokens", login, map[string]interface{}{
+			"name":   "script",
+			"scopes": scopes,
+		})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create token: got %d %s", rec.Code, rec.Body)
+		}
+		response := struct {
+			Id    string `json:"id"`
+			Token string `json:"token"`
+		}{}
+		decodeBody(t, rec, &response)
+		return response.Id, response.Token
+	}
+	chirp := map[string]string{"body": "posted by a script"}
+
+	_, readOnly := createToken(scopeProfileRead)
+	if rec := do(t, router, http.MethodPost, "/api/chirps", readOnly, chirp); rec.Code != http.StatusForbidden {
+		t.Errorf("token without chirps:write: got %d, want 403", rec.Code)
+	}
+
+	writerId, writer := createToken(scopeChirpsWrite)
+	if rec := do(t, router, http.MethodPost, "/api/chirps", writer, chirp); rec.Code != http.StatusCreated {
+		t.Errorf("token with chirps:write: got %d %s, want 201", rec.Code, rec.Body)
+	}
+	// a token can't mint more tokens
+	rec := do(t, router, http.MethodPost, "/api/tokens", writer, map[string]interface{}{"name": "more", "scopes": []string{scopeChirpsWrite}})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("creating a token with a token: got %d, want 403", rec.Code)
+	}
+
+	rec = do(t, router, http.MethodDelete, "/api/tokens/"+writerId, login, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete token: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, router, http.MethodPost, "/api/chirps", writer, chirp); rec.Code != http.StatusUnauthorized {
+		t.Errorf("deleted token: got %d, want 401", rec.Code)
+	}
+}
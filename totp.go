@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP codes follow RFC 6238 with the defaults every authenticator app supports.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes from one step before or after the current one are accepted for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	tokenTypeMFAChallenge = "mfa_challenge"
+	mfaChallengeTTL       = 5 * time.Minute
+
+	// tokenTypeMFAEnrollment is the token a user who must use two-factor authentication
+	// gets before they have enrolled, only middlewareEnrollment accepts it
+	tokenTypeMFAEnrollment = "mfa_enrollment"
+	// scope2FAEnroll is the scope of the principal of an enrollment token
+	scope2FAEnroll     = "2fa:enroll"
+	enrollmentTokenTTL = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(randomBytes), nil
+}
+
+// totpCode computes the code of secret for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validateTOTP returns the time step code belongs to, looking totpSkew steps around now.
+func validateTOTP(secret string, code string, now time.Time) (int64, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, errInvalidToken
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, errInvalidToken
+}
+
+func totpURI(secret string, email string) string {
+	label := url.PathEscape(tokenIssuer + ":" + email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", tokenIssuer)
+	query.Set("period", strconv.Itoa(totpPeriod))
+	query.Set("digits", strconv.Itoa(totpDigits))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns the codes to show the user once and the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		randomBytes := make([]byte, 5)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(randomBytes)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// twoFactorRequired reports whether the user may only log in with TOTP,
+// either because an admin said so or because they are an admin.
+func twoFactorRequired(user User) bool {
+	return user.Require2FA || user.HasRole(roleAdmin)
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code and burns it.
+func checkSecondFactor(db *DB, apiCfg *apiConfig, user User, code string, recoveryCode string) error {
+	if !user.TOTPEnabled {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if recoveryCode != "" {
+		return db.UseRecoveryCode(user.Id, hashToken(normalizeRecoveryCode(recoveryCode)))
+	}
+	step, err := validateTOTP(user.TOTPSecret, code, apiCfg.now())
+	if err != nil {
+		return err
+	}
+	return db.UseTOTPStep(user.Id, step)
+}
+
+// writeTwoFactorChallenge answers the password step of a login for a user with TOTP,
+// the challenge token is exchanged for the real tokens at /api/login/2fa.
+func writeTwoFactorChallenge(w http.ResponseWriter, apiCfg *apiConfig, user User) {
+	challengeToken, err := issueToken(apiCfg, user.Id, mfaChallengeTTL, tokenClaims{
+		TokenType: tokenTypeMFAChallenge,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		MFARequired    bool   `json:"mfa_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}{
+		MFARequired:    true,
+		ChallengeToken: challengeToken,
+	})
+}
+
+// writeEnrollmentToken answers a login of a user who must use two-factor authentication
+// but hasn't enrolled yet, the token they get can do nothing but enroll.
+func writeEnrollmentToken(w http.ResponseWriter, apiCfg *apiConfig, user User) {
+	enrollmentToken, err := issueToken(apiCfg, user.Id, enrollmentTokenTTL, tokenClaims{
+		TokenType: tokenTypeMFAEnrollment,
+		Scope:     scope2FAEnroll,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Id                    int    `json:"id"`
+		Email                 string `json:"email"`
+		Token                 string `json:"token"`
+		MFAEnrollmentRequired bool   `json:"mfa_enrollment_required"`
+	}{
+		Id:                    user.Id,
+		Email:                 user.Email,
+		Token:                 enrollmentToken,
+		MFAEnrollmentRequired: true,
+	})
+}
+
+// middlewareEnrollment guards the two-factor enrollment routes. They take an enrollment
+// token, which no other route accepts, or a token from a full login.
+func (cfg *apiConfig) middlewareEnrollment(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, err := bearerToken(r)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		claims, err := parseToken(cfg, tokenString, tokenTypeMFAEnrollment)
+		if err != nil {
+			cfg.middlewareFullAccess(next).ServeHTTP(w, r)
+			return
+		}
+		userId, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		if !cfg.checkRateLimit(w, cfg.db, userId) {
+			return
+		}
+		principal := Principal{UserId: userId, Scopes: []string{scope2FAEnroll}}
+		ctx := context.WithValue(r.Context(), principalContextKey{}, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func loginTwoFactor(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		ChallengeToken     string `json:"challenge_token"`
+		Code               string `json:"code"`
+		RecoveryCode       string `json:"recovery_code"`
+		Expires_In_Seconds int    `json:"expires_in_seconds"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseToken(apiCfg, bodyFetched.ChallengeToken, tokenTypeMFAChallenge)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
+	user, err := GetUserById(db, userId)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
+
+	// codes are guessed against the same counters as passwords
+	ip := clientIP(r)
+	err = apiCfg.loginThrottle.Check(user.Email, ip, apiCfg.now())
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+	err = checkSecondFactor(db, apiCfg, user, bodyFetched.Code, bodyFetched.RecoveryCode)
+	if err != nil {
+		apiCfg.loginThrottle.Failure(user.Email, ip, apiCfg.now())
+		http.Error(w, "invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	// a challenge can only be answered once
+	err = apiCfg.revocations.Revoke(db, claims.Id, time.Unix(claims.ExpiresAt, 0).UTC())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	completeLogin(w, r, db, apiCfg, user, bodyFetched.Expires_In_Seconds)
+}
+
+// twoFactorEnroll creates a new secret for the user, it only takes effect once a
+// code generated from it is sent to twoFactorConfirm.
+func twoFactorEnroll(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = db.SetTOTPSecret(user.Id, secret)
+	if errors.Is(err, errTOTPEnabled) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		QRCodeURL  string `json:"qr_code_url"`
+	}{
+		Secret:     secret,
+		OTPAuthURI: totpURI(secret, user.Email),
+		QRCodeURL:  apiCfg.baseURL + "/api/2fa/qr.png",
+	})
+}
+
+// twoFactorQRCode renders the otpauth URI of the pending secret as a PNG for authenticator apps.
+func twoFactorQRCode(w http.ResponseWriter, r *http.Request, db *DB) {
+	principal, _ := principalFromContext(r.Context())
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPSecret == "" || user.TOTPEnabled {
+		http.Error(w, "no two-factor enrollment in progress", http.StatusNotFound)
+		return
+	}
+
+	png, err := qrcode.Encode(totpURI(user.TOTPSecret, user.Email), qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the image contains the secret
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+}
+
+// twoFactorConfirm turns on two-factor authentication once the user proves their
+// app has the secret, and returns the recovery codes. They are never shown again.
+func twoFactorConfirm(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		Code string `json:"code"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, errTOTPEnabled.Error(), http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "no two-factor enrollment in progress", http.StatusBadRequest)
+		return
+	}
+	step, err := validateTOTP(user.TOTPSecret, bodyFetched.Code, apiCfg.now())
+	if err != nil {
+		http.Error(w, "invalid two-factor code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = db.EnableTOTP(user.Id, step, hashes)
+	if errors.Is(err, errTOTPEnabled) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+// twoFactorDisable turns off two-factor authentication, it asks for the password
+// and a current code so a stolen token alone can't do it.
+func twoFactorDisable(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	user, err := GetUserById(db, principal.UserId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if twoFactorRequired(user) {
+		http.Error(w, "two-factor authentication is required for this account", http.StatusForbidden)
+		return
+	}
+	err = apiCfg.passwords.Compare(user.Password, bodyFetched.Password)
+	if err != nil {
+		http.Error(w, "password does not match !", http.StatusUnauthorized)
+		return
+	}
+	err = checkSecondFactor(db, apiCfg, user, bodyFetched.Code, bodyFetched.RecoveryCode)
+	if err != nil {
+		http.Error(w, "invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	err = db.DisableTOTP(user.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
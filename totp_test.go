@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// enrollTOTP turns on two-factor authentication for the user and returns the
+// secret and the recovery codes.
+func enrollTOTP(t *testing.T, env *testEnv, user User) (string, []string) {
+	t.Helper()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.db.SetTOTPSecret(user.Id, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.db.EnableTOTP(user.Id, 0, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, codes
+}
+
+// currentTOTP is the code an authenticator app would show right now.
+func currentTOTP(t *testing.T, env *testEnv, secret string) string {
+	t.Helper()
+	code, err := totpCode(secret, env.cfg.now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestEnrollmentTokenOnlyEnrolls(t *testing.T) {
+	env := newTestEnv(t)
+	user := env.createUser(t, "user@example.com")
+	err := env.db.SetRequire2FA(user.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := accountRouter(env).(*chi.Mux)
+	router.With(env.cfg.middlewareEnrollment).Post("/api/2fa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		twoFactorEnroll(w, r, env.db, env.cfg)
+	})
+	router.With(env.cfg.middlewareAuthRequired).Get("/api/entitlements", func(w http.ResponseWriter, r *http.Request) {
+		entitlementsGet(w, r, env.db, env.cfg)
+	})
+	router.With(env.cfg.middlewareScope(scopeChirpsWrite)).Post("/api/chirps", func(w http.ResponseWriter, r *http.Request) {
+		chirpsPost(w, r, env.db, env.cfg)
+	})
+	router.With(env.cfg.middlewareScope(scopeProfileWrite)).Put("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		usersPut(w, r, env.db, env.cfg)
+	})
+
+	rec := do(t, router, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "user@example.com",
+		"password": testPassword,
+	})
+	response := struct {
+		Token                 string `json:"token"`
+		MFAEnrollmentRequired bool   `json:"mfa_enrollment_required"`
+	}{}
+	decodeBody(t, rec, &response)
+	if !response.MFAEnrollmentRequired {
+		t.Fatalf("login: got %s, want an enrollment token", rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{name: "enroll", method: http.MethodPost, path: "/api/2fa/enroll", status: http.StatusOK},
+		{name: "auth required route", method: http.MethodGet, path: "/api/entitlements", status: http.StatusUnauthorized},
+		{name: "scoped route", method: http.MethodPost, path: "/api/chirps", body: map[string]string{"body": "hi"}, status: http.StatusUnauthorized},
+		{name: "change password", method: http.MethodPut, path: "/api/users", body: map[string]string{"password": "another password", "current_password": testPassword}, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, router, tt.method, tt.path, response.Token, tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+		})
+	}
+}
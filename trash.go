@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Retention is how long deleted records can be restored before they are purged.
+type Retention struct {
+	ChirpDays int `json:"chirp_days"`
+	UserDays  int `json:"user_days"`
+}
+
+func (retention Retention) ChirpPurgeAt(deletedAt time.Time) time.Time {
+	return deletedAt.Add(time.Duration(retention.ChirpDays) * 24 * time.Hour)
+}
+
+func (retention Retention) UserPurgeAt(deletedAt time.Time) time.Time {
+	return deletedAt.Add(time.Duration(retention.UserDays) * 24 * time.Hour)
+}
+
+// retention returns the retention an admin set, falling back to the configured defaults.
+func (cfg *apiConfig) retention() (Retention, error) {
+	retention, err := cfg.db.GetRetention()
+	if err != nil {
+		return Retention{}, err
+	}
+	if retention == nil {
+		return cfg.defaultRetention, nil
+	}
+	return *retention, nil
+}
+
+// trashGet lists the caller's deleted chirps and when each will be purged.
+func trashGet(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	chirps, err := db.GetDeletedChirpsByAuthor(principal.UserId)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	retention, err := apiCfg.retention()
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].DeletedAt.After(*chirps[j].DeletedAt)
+	})
+
+	type trashedChirp struct {
+		Chirp
+		PurgeAt time.Time `json:"purge_at"`
+	}
+	trashed := []trashedChirp{}
+	for _, chirp := range chirps {
+		trashed = append(trashed, trashedChirp{
+			Chirp:   chirp,
+			PurgeAt: retention.ChirpPurgeAt(*chirp.DeletedAt),
+		})
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Chirps []trashedChirp `json:"chirps"`
+	}{
+		Chirps: trashed,
+	})
+}
+
+func adminRetentionGet(w http.ResponseWriter, r *http.Request, apiCfg *apiConfig) {
+	retention, err := apiCfg.retention()
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, retention)
+}
+
+func adminRetentionPut(w http.ResponseWriter, r *http.Request, db *DB) {
+	retention := Retention{}
+	err := json.NewDecoder(r.Body).Decode(&retention)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	if retention.ChirpDays < 1 || retention.UserDays < 1 {
+		http.Error(w, "retention must be at least one day", http.StatusBadRequest)
+		return
+	}
+	err = db.SetRetention(retention)
+	if err != nil {
+		http.Error(w, "Database problem", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, retention)
+}
+
+// purgeTrash periodically removes users and chirps whose retention period is over,
+// and the exports nobody downloaded in time.
+func purgeTrash(db *DB, apiCfg *apiConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		apiCfg.exports.prune(apiCfg.now())
+		retention, err := apiCfg.retention()
+		if err != nil {
+			log.Print("Error loading retention: " + err.Error())
+			continue
+		}
+		userIds, chirpIds, err := db.PurgeDeleted(apiCfg.now(), retention)
+		if err != nil {
+			log.Print("Error purging deleted records: " + err.Error())
+			continue
+		}
+		if len(userIds) > 0 {
+			log.Printf("Purged deleted accounts: %v", userIds)
+		}
+		if len(chirpIds) > 0 {
+			log.Printf("Purged deleted chirps: %v", chirpIds)
+		}
+	}
+}
@@ -1,20 +1,18 @@
 package main
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func userPost(w http.ResponseWriter, r *http.Request, db *DB) {
+func userPost(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
 	type requestBodyParams struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Password    string `json:"password"`
+		Email       string `json:"email"`
+		Handle      string `json:"handle"`
+		DisplayName string `json:"display_name"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	bodyFetched := requestBodyParams{}
@@ -24,27 +22,70 @@ func userPost(w http.ResponseWriter, r *http.Request, db *DB) {
 
 	if err != nil {
 		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(bodyFetched.Password), bcrypt.DefaultCost)
+	err = validateEmail(bodyFetched.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bodyFetched.Handle != "" {
+		err = validateHandle(bodyFetched.Handle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = validateProfile(bodyFetched.DisplayName, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	user, err := db.CreateUser(bodyFetched.Email, string(hashedPassword))
+	hashedPassword, err := apiCfg.hashNewPassword(bodyFetched.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.CreateUser(bodyFetched.Email, hashedPassword, bodyFetched.Handle, bodyFetched.DisplayName, apiCfg.now())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+	apiCfg.emitEvent(eventUserCreated, struct {
+		Id          int       `json:"id"`
+		Handle      string    `json:"handle"`
+		DisplayName string    `json:"display_name"`
+		CreatedAt   time.Time `json:"created_at"`
+	}{
+		Id:          user.Id,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		CreatedAt:   user.CreatedAt,
+	})
+
+	// the account is usable without a verified email, so a mailer outage shouldn't fail sign up
+	err = sendVerificationEmail(db, apiCfg, user)
+	if err != nil {
+		log.Print("Error sending verification email: " + err.Error())
+	}
 
 	userWithoutPassword := struct {
 		Id    int
 		Email string
 		Is_Chirpy_Red bool `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+		Handle        string `json:"handle"`
+		DisplayName   string `json:"display_name"`
 	}{
 		Id:    user.Id,
 		Email: user.Email,
-		Is_Chirpy_Red: user.Is_Chirpy_Red,
+		Is_Chirpy_Red: user.IsChirpyRed(apiCfg.now()),
+		EmailVerified: user.EmailVerified,
+		Handle:        user.Handle,
+		DisplayName:   user.DisplayName,
 	}
 
 	// Marshal the response into JSON
@@ -62,38 +103,8 @@ func userPost(w http.ResponseWriter, r *http.Request, db *DB) {
 }
 
 func usersPut(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authorizationString, "Bearer ")
-	// Validate and parse the JWT token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return apiCfg.jwtSecret, nil
-	})
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	claims, ok := token.Claims.(*jwt.StandardClaims)
-	if !ok || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-	if claims.Issuer == "chirpy-refresh"{
-		http.Error(w, "token must be of access type", http.StatusUnauthorized)
-		log.Print("as the token was refresh, we return from PUT request !")
-		return 
-	}
-	// Check token expiration
-	if time.Now().UTC().Unix() > claims.ExpiresAt {
-		http.Error(w, "Token has expired", http.StatusUnauthorized)
-		return
-	}
-	// Extract the user ID from the token claims
-	userId, err := strconv.Atoi(claims.Subject)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
+	principal, _ := principalFromContext(r.Context())
+	userId := principal.UserId
 
 	// Retrieve the user from the database using the user ID
 	findUser, err := GetUserById(db, userId)
@@ -102,27 +113,88 @@ func usersPut(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig)
 		return
 	}
 
+	// every field is optional, only the ones that are sent get changed
 	type requestBodyParams struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Password        *string `json:"password"`
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"current_password"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	bodyFetched := requestBodyParams{}
 	err = decoder.Decode(&bodyFetched)
 
 	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(bodyFetched.Password), bcrypt.DefaultCost)
+	emailChanged := bodyFetched.Email != nil && normalizeEmail(*bodyFetched.Email) != normalizeEmail(findUser.Email)
+	passwordChanged := bodyFetched.Password != nil
+
+	// changing the email or password needs the current password as well as the token,
+	// and wrong guesses count towards a lockout like failed logins
+	if emailChanged || passwordChanged {
+		_, err = authenticateUser(db, apiCfg, clientIP(r), findUser.Email, bodyFetched.CurrentPassword)
+		var locked loginLockedError
+		if errors.As(err, &locked) {
+			writeLoginError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "current password does not match !", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if emailChanged {
+		err = validateEmail(*bodyFetched.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = GetUser(db, *bodyFetched.Email)
+		if err == nil {
+			http.Error(w, errEmailTaken.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	if passwordChanged {
+		hashedPassword, err := apiCfg.hashNewPassword(*bodyFetched.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = db.SetPassword(findUser.Id, hashedPassword)
+		if err != nil {
+			log.Print("Error updating password: " + err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// everyone else who was logged in has to log in again with the new password
+		err = db.RevokeOtherSessions(findUser.Id, principal.SessionId)
+		if err != nil {
+			log.Print("Error revoking sessions: " + err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// the new email only takes effect once the link sent to it has been opened
+	pendingEmail := ""
+	if emailChanged {
+		err = sendEmailChangeEmails(db, apiCfg, findUser, *bodyFetched.Email)
+		if err != nil {
+			log.Print("Error sending email change emails: " + err.Error())
+			http.Error(w, "could not send email", http.StatusInternalServerError)
+			return
+		}
+		pendingEmail = *bodyFetched.Email
+	}
+
+	updatedUser, err := GetUserById(db, findUser.Id)
 	if err != nil {
-		log.Print("hashing skill issues")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
-
-	updatedUser, err := UpdateUser(findUser.Id, bodyFetched.Email, string(hashedPassword), db)
-	if err != nil {
-		log.Fatal(err.Error() + " -> update error")
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
@@ -130,10 +202,12 @@ func usersPut(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig)
 		Id    int
 		Email string
 		Is_Chirpy_Red bool `json:"is_chirpy_red"`
+		PendingEmail  string `json:"pending_email,omitempty"`
 	}{
 		Id:    updatedUser.Id,
 		Email: updatedUser.Email,
-		Is_Chirpy_Red: updatedUser.Is_Chirpy_Red,
+		Is_Chirpy_Red: updatedUser.IsChirpyRed(apiCfg.now()),
+		PendingEmail:  pendingEmail,
 	}
 
 	// Marshal the response into JSON
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestEmailsIgnoreCase(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+
+	rec := do(t, router, http.MethodPost, "/api/users", "", map[string]string{
+		"email":    "Foo@Example.com",
+		"password": testPassword,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup: got %d %s", rec.Code, rec.Body)
+	}
+	user := User{}
+	decodeBody(t, rec, &user)
+	if user.Email != "foo@example.com" {
+		t.Errorf("stored email: got %q, want it lower cased", user.Email)
+	}
+
+	rec = do(t, router, http.MethodPost, "/api/users", "", map[string]string{
+		"email":    "foo@example.com",
+		"password": testPassword,
+	})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("signup with the same email in another case: got %d, want 409", rec.Code)
+	}
+
+	rec = do(t, router, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "FOO@example.COM",
+		"password": testPassword,
+	})
+	if rec.Code != http.StatusOK {
+		t.Errorf("login in another case: got %d %s, want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestSignUpUsesTheConfigClock(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+
+	rec := do(t, router, http.MethodPost, "/api/users", "", map[string]string{
+		"email":    "user@example.com",
+		"password": testPassword,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup: got %d %s", rec.Code, rec.Body)
+	}
+	user, err := GetUser(env.db, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.CreatedAt.Equal(env.cfg.now()) {
+		t.Errorf("created at %v, want %v", user.CreatedAt, env.cfg.now())
+	}
+}
+
+// usersRouter is accountRouter with PUT /api/users.
+func usersRouter(env *testEnv) http.Handler {
+	router := accountRouter(env).(*chi.Mux)
+	router.With(env.cfg.middlewareScope(scopeProfileWrite)).Put("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		usersPut(w, r, env.db, env.cfg)
+	})
+	return router
+}
+
+// loginTokens logs in with testPassword and returns the access and refresh token.
+func loginTokens(t *testing.T, router http.Handler, email string) (string, string) {
+	t.Helper()
+	rec := do(t, router, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: got %d %s", rec.Code, rec.Body)
+	}
+	response := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	decodeBody(t, rec, &response)
+	return response.Token, response.RefreshToken
+}
+
+func TestCurrentPasswordGuessesAreThrottled(t *testing.T) {
+	env := newTestEnv(t)
+	router := usersRouter(env)
+	env.createUser(t, "user@example.com")
+	token, _ := loginTokens(t, router, "user@example.com")
+
+	change := func(current string) int {
+		return do(t, router, http.MethodPut, "/api/users", token, map[string]string{
+			"password":         "a brand new password",
+			"current_password": current,
+		}).Code
+	}
+	for i := 0; i < accountFreeAttempts; i++ {
+		if code := change("wrong guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: got %d, want 401", i+1, code)
+		}
+	}
+	if code := change(testPassword); code != http.StatusTooManyRequests {
+		t.Errorf("after %d wrong guesses: got %d, want 429", accountFreeAttempts, code)
+	}
+}
+
+func TestPasswordChangeEndsOtherSessions(t *testing.T) {
+	env := newTestEnv(t)
+	router := usersRouter(env)
+	env.createUser(t, "user@example.com")
+	current, _ := loginTokens(t, router, "user@example.com")
+	other, otherRefresh := loginTokens(t, router, "user@example.com")
+
+	rec := do(t, router, http.MethodPut, "/api/users", current, map[string]string{
+		"password":         "a brand new password",
+		"current_password": testPassword,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("change: got %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(t, router, http.MethodGet, "/api/sessions", current, nil); rec.Code != http.StatusOK {
+		t.Errorf("the session that changed the password: got %d, want 200", rec.Code)
+	}
+	if rec := do(t, router, http.MethodGet, "/api/sessions", other, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("another session: got %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, http.MethodPost, "/api/refresh", otherRefresh, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("another session's refresh token: got %d, want 401", rec.Code)
+	}
+}
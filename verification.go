@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposePasswordReset = "password_reset"
+	purposeEmailChange   = "email_change"
+
+	verifyEmailTTL   = 24 * time.Hour
+	passwordResetTTL = time.Hour
+	emailChangeTTL   = 24 * time.Hour
+
+	passwordResetsPerEmail = 3
+	passwordResetsPerIP    = 10
+	passwordResetWindow    = 15 * time.Minute
+)
+
+// validateEmail only accepts a bare address such as "name@example.com".
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// normalizeEmail is how emails are stored and looked up, addresses that only differ
+// in case or surrounding space are the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// hashToken is how one-time tokens are stored, so a leaked database can't be used to redeem them.
+func hashToken(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 32 random bytes hex encoded.
+func randomToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// issueOneTimeToken stores a new single-use token that expires at expiresAt and returns
+// the raw value to send to the user.
+func issueOneTimeToken(db *DB, userId int, purpose string, expiresAt time.Time, newEmail string) (string, error) {
+	rawToken, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = db.SaveOneTimeToken(hashToken(rawToken), OneTimeToken{
+		UserId:    userId,
+		Purpose:   purpose,
+		ExpiresAt: expiresAt,
+		NewEmail:  newEmail,
+	})
+	if err != nil {
+		return "", err
+	}
+	return rawToken, nil
+}
+
+func sendVerificationEmail(db *DB, apiCfg *apiConfig, user User) error {
+	rawToken, err := issueOneTimeToken(db, user.Id, purposeVerifyEmail, apiCfg.now().Add(verifyEmailTTL), "")
+	if err != nil {
+		return err
+	}
+	link := apiCfg.baseURL + "/api/users/verify?token=" + url.QueryEscape(rawToken)
+	return apiCfg.mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body:    "Welcome to Chirpy! Confirm your email address by opening this link:\n\n" + link + "\n\nThe link expires in 24 hours.",
+	})
+}
+
+// requireVerified writes a 403 and returns false if the user has not verified their email.
+func requireVerified(w http.ResponseWriter, db *DB, userId int) bool {
+	user, err := GetUserById(db, userId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if !user.EmailVerified {
+		http.Error(w, "email address is not verified", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	rawToken := r.URL.Query().Get("token")
+	token, err := db.ConsumeOneTimeToken(hashToken(rawToken), purposeVerifyEmail, apiCfg.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.SetEmailVerified(token.UserId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		EmailVerified bool `json:"email_verified"`
+	}{
+		EmailVerified: true,
+	})
+}
+
+func resendVerification(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	principal, _ := principalFromContext(r.Context())
+	userId := principal.UserId
+	user, err := GetUserById(db, userId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "email address is already verified", http.StatusConflict)
+		return
+	}
+	err = sendVerificationEmail(db, apiCfg, user)
+	if err != nil {
+		log.Print("Error sending verification email: " + err.Error())
+		http.Error(w, "could not send email", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// passwordForgot always answers 202 so it can't be used to find out which emails have accounts.
+func passwordForgot(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		Email string `json:"email"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+
+	// emails are limited whether or not they have an account
+	now := apiCfg.now()
+	allowed, retryAfter := apiCfg.passwordResetIPLimiter.Allow(clientIP(r), now)
+	if allowed {
+		allowed, retryAfter = apiCfg.passwordResetEmailLimiter.Allow(accountKey(bodyFetched.Email), now)
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "too many password resets requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	sendInBackground("password reset", func() error {
+		user, err := GetUser(db, bodyFetched.Email)
+		if err != nil {
+			return nil
+		}
+		return sendPasswordResetEmail(db, apiCfg, user)
+	})
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func sendPasswordResetEmail(db *DB, apiCfg *apiConfig, user User) error {
+	rawToken, err := issueOneTimeToken(db, user.Id, purposePasswordReset, apiCfg.now().Add(passwordResetTTL), "")
+	if err != nil {
+		return err
+	}
+	return apiCfg.mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    "Someone asked to reset your Chirpy password. If it was you, use this token with /api/password/reset:\n\n" + rawToken + "\n\nThe token expires in 1 hour. If it wasn't you, you can ignore this email.",
+	})
+}
+
+func passwordReset(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	type requestBodyParams struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	bodyFetched := requestBodyParams{}
+	err := json.NewDecoder(r.Body).Decode(&bodyFetched)
+	if err != nil {
+		http.Error(w, "Something went wrong!", http.StatusBadRequest)
+		return
+	}
+	err = apiCfg.passwordPolicy.Validate(bodyFetched.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := db.ConsumeOneTimeToken(hashToken(bodyFetched.Token), purposePasswordReset, apiCfg.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := apiCfg.passwords.Hash(bodyFetched.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.SetPassword(token.UserId, hashedPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// the reset link proved the user owns the address
+	err = db.SetEmailVerified(token.UserId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// whoever knew the old password must not stay logged in
+	err = db.RevokeAllSessions(token.UserId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// sendEmailChangeEmails sends the confirmation link to the new address and a heads-up to the old one.
+func sendEmailChangeEmails(db *DB, apiCfg *apiConfig, user User, newEmail string) error {
+	rawToken, err := issueOneTimeToken(db, user.Id, purposeEmailChange, apiCfg.now().Add(emailChangeTTL), newEmail)
+	if err != nil {
+		return err
+	}
+	link := apiCfg.baseURL + "/api/users/email/confirm?token=" + url.QueryEscape(rawToken)
+	err = apiCfg.mailer.Send(Message{
+		To:      newEmail,
+		Subject: "Confirm your new Chirpy email address",
+		Body:    "Confirm that this is the new email address of your Chirpy account by opening this link:\n\n" + link + "\n\nThe link expires in 24 hours.",
+	})
+	if err != nil {
+		return err
+	}
+	return apiCfg.mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Your Chirpy email address is being changed",
+		Body:    "Someone asked to change the email address of your Chirpy account to " + newEmail + ".\n\nIf this wasn't you, reset your password right away.",
+	})
+}
+
+func confirmEmailChange(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig) {
+	rawToken := r.URL.Query().Get("token")
+	token, err := db.ConsumeOneTimeToken(hashToken(rawToken), purposeEmailChange, apiCfg.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// someone else may have taken the address since the link was sent
+	err = db.SetEmail(token.UserId, token.NewEmail)
+	if errors.Is(err, errEmailTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Email string `json:"email"`
+	}{
+		Email: token.NewEmail,
+	})
+}
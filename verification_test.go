@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func accountRouter(env *testEnv) http.Handler {
+	r := chi.NewRouter()
+	r.Post("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		userPost(w, r, env.db, env.cfg)
+	})
+	r.Get("/api/users/verify", func(w http.ResponseWriter, r *http.Request) {
+		verifyEmail(w, r, env.db, env.cfg)
+	})
+	r.Post("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		userLogin(w, r, env.db, env.cfg)
+	})
+	r.Post("/api/refresh", func(w http.ResponseWriter, r *http.Request) {
+		refresh(w, r, env.db, env.cfg)
+	})
+	r.Post("/api/revoke", func(w http.ResponseWriter, r *http.Request) {
+		revoke(w, r, env.db, env.cfg)
+	})
+	r.Post("/api/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		passwordForgot(w, r, env.db, env.cfg)
+	})
+	r.Post("/api/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		passwordReset(w, r, env.db, env.cfg)
+	})
+	r.With(env.cfg.middlewareFullAccess).Get("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessionsGet(w, r, env.db)
+	})
+	r.With(env.cfg.middlewareFullAccess).Delete("/api/sessions/{sessionID}", func(w http.ResponseWriter, r *http.Request) {
+		sessionDelete(w, r, env.db)
+	})
+	r.With(env.cfg.middlewareFullAccess).Post("/api/logout-all", func(w http.ResponseWriter, r *http.Request) {
+		logoutAll(w, r, env.db)
+	})
+	return r
+}
+
+func TestVerifyEmailExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		after  time.Duration
+		status int
+	}{
+		{name: "within a day", after: 23 * time.Hour, status: http.StatusOK},
+		{name: "after a day", after: 25 * time.Hour, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := accountRouter(env)
+			rec := do(t, router, http.MethodPost, "/api/users", "", map[string]string{
+				"email":    "new@example.com",
+				"password": testPassword,
+			})
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("signup: got %d %s", rec.Code, rec.Body)
+			}
+			token := tokenFromEmail(t, env.mailer.Last(t, "new@example.com"))
+
+			env.clock.Advance(tt.after)
+			rec = do(t, router, http.MethodGet, "/api/users/verify?token="+url.QueryEscape(token), "", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("verify: got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		after  time.Duration
+		status int
+	}{
+		{name: "within the hour", after: 59 * time.Minute, status: http.StatusOK},
+		{name: "after the hour", after: 61 * time.Minute, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			router := accountRouter(env)
+			env.createUser(t, "user@example.com")
+
+			rec := do(t, router, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": "user@example.com"})
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("forgot: got %d %s", rec.Code, rec.Body)
+			}
+			token := tokenFromEmail(t, env.mailer.Last(t, "user@example.com"))
+
+			env.clock.Advance(tt.after)
+			rec = do(t, router, http.MethodPost, "/api/password/reset", "", map[string]string{
+				"token":    token,
+				"password": "a brand new password",
+			})
+			if rec.Code != tt.status {
+				t.Fatalf("reset: got %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+	env.createUser(t, "user@example.com")
+
+	type loginResponse struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	login := func(password string) (loginResponse, int) {
+		rec := do(t, router, http.MethodPost, "/api/login", "", map[string]string{
+			"email":    "user@example.com",
+			"password": password,
+		})
+		response := loginResponse{}
+		if rec.Code == http.StatusOK {
+			decodeBody(t, rec, &response)
+		}
+		return response, rec.Code
+	}
+
+	// the old password is still known to whoever stole it
+	stolen, code := login(testPassword)
+	if code != http.StatusOK {
+		t.Fatalf("login: got %d", code)
+	}
+	rec := do(t, router, http.MethodGet, "/api/sessions", stolen.Token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sessions before the reset: got %d %s", rec.Code, rec.Body)
+	}
+
+	do(t, router, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": "user@example.com"})
+	rec = do(t, router, http.MethodPost, "/api/password/reset", "", map[string]string{
+		"token":    tokenFromEmail(t, env.mailer.Last(t, "user@example.com")),
+		"password": "a brand new password",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reset: got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, router, http.MethodGet, "/api/sessions", stolen.Token, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token after the reset: got %d, want 401", rec.Code)
+	}
+	rec = do(t, router, http.MethodPost, "/api/refresh", stolen.RefreshToken, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token after the reset: got %d, want 401", rec.Code)
+	}
+	if _, code := login(testPassword); code != http.StatusUnauthorized {
+		t.Errorf("login with the old password: got %d, want 401", code)
+	}
+	if _, code := login("a brand new password"); code != http.StatusOK {
+		t.Errorf("login with the new password: got %d, want 200", code)
+	}
+}
+
+func TestPasswordForgotThrottled(t *testing.T) {
+	env := newTestEnv(t)
+	router := accountRouter(env)
+	env.createUser(t, "user@example.com")
+
+	// unknown emails are limited the same way, so the limit doesn't reveal accounts
+	for _, email := range []string{"user@example.com", "nobody@example.com"} {
+		for i := 0; i < passwordResetsPerEmail; i++ {
+			rec := do(t, router, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("%s request %d: got %d %s", email, i+1, rec.Code, rec.Body)
+			}
+		}
+		rec := do(t, router, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s over the limit: got %d, want 429 with Retry-After", email, rec.Code)
+		}
+	}
+
+	env.clock.Advance(passwordResetWindow)
+	rec := do(t, router, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": "user@example.com"})
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("after the window: got %d, want 202", rec.Code)
+	}
+}
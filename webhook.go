@@ -1,47 +1,123 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	polkaTimestampHeader = "X-Polka-Timestamp"
+	polkaSignatureHeader = "X-Polka-Signature"
+
+	// event ids are remembered for this long, Polka stops retrying well before
+	webhookEventMemory  = 30 * 24 * time.Hour
+	maxWebhookBodyBytes = 1 << 20
+)
+
+// signWebhook is the HMAC-SHA256 of "<timestamp>.<body>", the signature scheme used
+// both by Polka and by our own outgoing webhooks.
+func signWebhook(key string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verifyPolkaSignature checks the signature header against the raw body. Polka signs
+// "<timestamp>.<body>" with HMAC-SHA256 and sends "sha256=<hex>", several comma
+// separated signatures are sent while it rotates keys. Any of our keys may match any
+// of them, so both sides can rotate without a coordinated switch.
+func verifyPolkaSignature(keys []string, timestamp string, signatureHeader string, body []byte, now time.Time, tolerance time.Duration) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-tolerance)) || signedAt.After(now.Add(tolerance)) {
+		return errors.New("timestamp is outside the tolerance window")
+	}
+
+	signatures := [][]byte{}
+	for _, val := range strings.Split(signatureHeader, ",") {
+		hexSignature, found := strings.CutPrefix(strings.TrimSpace(val), "sha256=")
+		if !found {
+			continue
+		}
+		signature, err := hex.DecodeString(hexSignature)
+		if err == nil {
+			signatures = append(signatures, signature)
+		}
+	}
+
+	for _, key := range keys {
+		expected := signWebhook(key, timestamp, body)
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature does not match")
+}
+
 func webhook(w http.ResponseWriter, r *http.Request, db *DB, apiCfg *apiConfig){
-	authorizationString := r.Header.Get("Authorization")
-	apiKey := strings.TrimPrefix(authorizationString, "ApiKey ")
-	if apiKey != apiCfg.polkaKey {
-		w.WriteHeader(401)
-		w.Write([]byte("{}"))
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	err = verifyPolkaSignature(apiCfg.polkaKeys, r.Header.Get(polkaTimestampHeader), r.Header.Get(polkaSignatureHeader), body, apiCfg.now(), apiCfg.polkaTolerance)
+	if err != nil {
+		http.Error(w, err.Error(), 401)
 		return
 	}
 
 	type requestBody struct{
+		Id    string `json:"id"`
 		Event string `json:"event"`
-		Data map[string] int `json:"data"`
 	}
 	bodyFetched := requestBody{}
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&bodyFetched)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	err = decoder.Decode(&bodyFetched)
 
 	if err != nil {
 		http.Error(w,err.Error(),400)
-		return 
-	}
-	if bodyFetched.Event != "user.upgraded" {
-		w.WriteHeader(200)
-		w.Write([]byte("{}"))
 		return
 	}
-	if bodyFetched.Event == "user.upgraded"{
-		err := ChirpyRed(db, bodyFetched.Data["user_id"])
-		if err != nil {
-			http.Error(w,err.Error(), 404)
-			w.Write([]byte("{}"))
-			return
-		}else{
-			w.WriteHeader(200)
-			w.Write([]byte("{}"))
-		}
+	if bodyFetched.Id == "" {
+		http.Error(w, "event id is required", 400)
+		return
 	}
 
-}
\ No newline at end of file
+	// the event is acknowledged once it is in the inbox, the worker applies it.
+	// A repeated delivery is acknowledged again but isn't stored twice.
+	now := apiCfg.now()
+	created, err := db.EnqueueWebhookEvent(InboxEvent{
+		Id:            bodyFetched.Id,
+		Source:        "polka",
+		Event:         bodyFetched.Event,
+		Payload:       body,
+		ReceivedAt:    now,
+		Status:        inboxPending,
+		NextAttemptAt: now,
+	}, webhookEventMemory)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if created {
+		apiCfg.wakeWebhookWorker()
+	}
+	w.WriteHeader(200)
+	w.Write([]byte("{}"))
+}
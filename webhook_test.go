@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// polkaSignature is the signature header Polka sends when it signs with keys.
+func polkaSignature(timestamp string, body []byte, keys ...string) string {
+	signatures := []string{}
+	for _, key := range keys {
+		signatures = append(signatures, "sha256="+hex.EncodeToString(signWebhook(key, timestamp, body)))
+	}
+	return strings.Join(signatures, ", ")
+}
+
+func TestVerifyPolkaSignature(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"id":"evt-1","event":"user.upgraded"}`)
+	signedAt := func(d time.Duration) string {
+		return strconv.FormatInt(now.Add(d).Unix(), 10)
+	}
+
+	tests := []struct {
+		name      string
+		keys      []string
+		timestamp string
+		signature string
+		valid     bool
+	}{
+		{name: "signed now", keys: []string{"old"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "old"), valid: true},
+		{name: "at the edge of the window", keys: []string{"old"}, timestamp: signedAt(-5 * time.Minute), signature: polkaSignature(signedAt(-5*time.Minute), body, "old"), valid: true},
+		{name: "too old", keys: []string{"old"}, timestamp: signedAt(-5*time.Minute - time.Second), signature: polkaSignature(signedAt(-5*time.Minute-time.Second), body, "old")},
+		{name: "too far in the future", keys: []string{"old"}, timestamp: signedAt(5*time.Minute + time.Second), signature: polkaSignature(signedAt(5*time.Minute+time.Second), body, "old")},
+		{name: "no timestamp", keys: []string{"old"}, signature: polkaSignature("", body, "old")},
+		{name: "timestamp changed after signing", keys: []string{"old"}, timestamp: signedAt(time.Second), signature: polkaSignature(signedAt(0), body, "old")},
+		{name: "wrong key", keys: []string{"old"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "stolen")},
+		{name: "no signature", keys: []string{"old"}, timestamp: signedAt(0)},
+		{name: "no keys configured", timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "old")},
+		{name: "without the sha256 prefix", keys: []string{"old"}, timestamp: signedAt(0), signature: hex.EncodeToString(signWebhook("old", signedAt(0), body))},
+		// both sides rotate on their own schedule
+		{name: "polka signs with both keys", keys: []string{"old"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "old", "new"), valid: true},
+		{name: "we accept both keys", keys: []string{"new", "old"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "old"), valid: true},
+		{name: "polka has switched to the new key", keys: []string{"new", "old"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "new"), valid: true},
+		{name: "old key retired", keys: []string{"new"}, timestamp: signedAt(0), signature: polkaSignature(signedAt(0), body, "old")},
+		{name: "one bad signature among good ones", keys: []string{"new"}, timestamp: signedAt(0), signature: "sha256=zz, " + polkaSignature(signedAt(0), body, "new"), valid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPolkaSignature(tt.keys, tt.timestamp, tt.signature, body, now, 5*time.Minute)
+			if tt.valid && err != nil {
+				t.Errorf("got %v, want a valid signature", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("got a valid signature, want an error")
+			}
+		})
+	}
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.polkaKeys = []string{"new", "old"}
+	env.cfg.polkaTolerance = 5 * time.Minute
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhook(w, r, env.db, env.cfg)
+	})
+	send := func(body []byte, timestamp string, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", bytes.NewReader(body))
+		req.Header.Set(polkaTimestampHeader, timestamp)
+		req.Header.Set(polkaSignatureHeader, signature)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	body := []byte(`{"id":"evt-1","event":"user.upgraded","data":{"user_id":1}}`)
+	now := strconv.FormatInt(env.cfg.now().Unix(), 10)
+	if code := send(body, now, polkaSignature(now, body, "stolen")); code != http.StatusUnauthorized {
+		t.Errorf("wrong key: got %d, want 401", code)
+	}
+	tampered := bytes.Replace(body, []byte(`"user_id":1`), []byte(`"user_id":2`), 1)
+	if code := send(tampered, now, polkaSignature(now, body, "old")); code != http.StatusUnauthorized {
+		t.Errorf("body changed after signing: got %d, want 401", code)
+	}
+	if code := send(body, now, polkaSignature(now, body, "old")); code != http.StatusOK {
+		t.Fatalf("signed with the old key: got %d, want 200", code)
+	}
+
+	// a replayed delivery is acknowledged but not stored again
+	env.clock.Advance(time.Minute)
+	later := strconv.FormatInt(env.cfg.now().Unix(), 10)
+	if code := send(body, later, polkaSignature(later, body, "new")); code != http.StatusOK {
+		t.Fatalf("replay: got %d, want 200", code)
+	}
+	events, err := env.db.GetWebhookEvents("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("got %d events in the inbox, want 1", len(events))
+	}
+
+	// a captured request can't be replayed once its timestamp is out of the window
+	env.clock.Advance(5 * time.Minute)
+	if code := send(body, now, polkaSignature(now, body, "old")); code != http.StatusUnauthorized {
+		t.Errorf("stale replay: got %d, want 401", code)
+	}
+}